@@ -0,0 +1,499 @@
+package activityserve
+
+import (
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// the special collection we address public activities to
+const activityStreamsPublic = "https://www.w3.org/ns/activitystreams#Public"
+
+// Object is an ActivityStreams object. Activities are objects too so the
+// properties of activities (actor, object, target) live here as well,
+// which lets us embed any of them in any other.
+//
+// Servers out there send a lot more properties than the ones we have
+// fields for. All the properties of a received object, known or not, are
+// kept in Raw and the unknown ones are sent along when we marshal the
+// object again.
+type Object struct {
+	Context      interface{}  `json:"@context,omitempty"`
+	ID           string       `json:"id,omitempty"`
+	Type         string       `json:"type,omitempty"`
+	Name         string       `json:"name,omitempty"`
+	Summary      string       `json:"summary,omitempty"`
+	Content      string       `json:"content,omitempty"`
+	MediaType    string       `json:"mediaType,omitempty"`
+	Source       *Source      `json:"source,omitempty"`
+	URL          Strings      `json:"url,omitempty"`
+	AttributedTo Strings      `json:"attributedTo,omitempty"`
+	InReplyTo    *IRIOrObject `json:"inReplyTo,omitempty"`
+	To           Strings      `json:"to,omitempty"`
+	CC           Strings      `json:"cc,omitempty"`
+	BTo          Strings      `json:"bto,omitempty"`
+	BCC          Strings      `json:"bcc,omitempty"`
+	Published    string       `json:"published,omitempty"`
+	Updated      string       `json:"updated,omitempty"`
+	Deleted      string       `json:"deleted,omitempty"`
+	FormerType   string       `json:"formerType,omitempty"`
+	Tag          Links        `json:"tag,omitempty"`
+	Attachment   Objects      `json:"attachment,omitempty"`
+	Width        int          `json:"width,omitempty"`
+	Height       int          `json:"height,omitempty"`
+	Blurhash     string       `json:"blurhash,omitempty"`
+	Sensitive    bool         `json:"sensitive,omitempty"`
+	Replies      *Collection  `json:"replies,omitempty"`
+	OneOf        Objects      `json:"oneOf,omitempty"`
+	AnyOf        Objects      `json:"anyOf,omitempty"`
+	EndTime      string       `json:"endTime,omitempty"`
+	Closed       interface{}  `json:"closed,omitempty"` // a date, or true from some servers
+	VotersCount  int          `json:"votersCount,omitempty"`
+	Actor        *IRIOrObject `json:"actor,omitempty"`
+	Object       *IRIOrObject `json:"object,omitempty"`
+	Target       *IRIOrObject `json:"target,omitempty"`
+
+	// Raw holds all the properties of the object as we received them
+	Raw map[string]interface{} `json:"-"`
+	// unread are the properties in Raw we couldn't read into their field
+	unread []string
+}
+
+// Activity is an object that describes something an actor did,
+// e.g. a Create, Follow or Announce
+type Activity = Object
+
+// Note is a short post
+type Note = Object
+
+// Article is a long post with a title
+type Article = Object
+
+// Tombstone is what's left of a deleted object
+type Tombstone = Object
+
+// UnmarshalJSON reads the known properties in the fields of the
+// object and keeps all of them in Raw
+func (o *Object) UnmarshalJSON(b []byte) error {
+	type object Object
+	var err error
+	o.unread, err = unmarshalLenient(b, (*object)(o))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &o.Raw)
+}
+
+// MarshalJSON writes the fields of the object along with any
+// unknown properties we have in Raw
+func (o Object) MarshalJSON() ([]byte, error) {
+	type object Object
+	return marshalWithRaw(object(o), o.Raw, o.unread)
+}
+
+// objectFromMap converts an object we have as a map (e.g. from storage)
+// into an Object
+func objectFromMap(m map[string]interface{}) (*Object, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	object := &Object{}
+	err = json.Unmarshal(b, object)
+	return object, err
+}
+
+// Source is what the content of an object was written in before it
+// was turned into html, e.g. Markdown
+type Source struct {
+	Content   string `json:"content"`
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// UnmarshalJSON accepts a source object or just its content
+func (s *Source) UnmarshalJSON(b []byte) error {
+	if firstByte(b) == '"' {
+		return json.Unmarshal(b, &s.Content)
+	}
+	type source Source
+	return json.Unmarshal(b, (*source)(s))
+}
+
+// IRIOrObject is a property that can hold either the iri of an object
+// or the object itself embedded
+type IRIOrObject struct {
+	IRI    string
+	Object *Object
+}
+
+// NewIRI returns a property holding just the iri of an object
+func NewIRI(iri string) *IRIOrObject {
+	return &IRIOrObject{IRI: iri}
+}
+
+// Embed returns a property holding a whole object
+func Embed(object *Object) *IRIOrObject {
+	return &IRIOrObject{IRI: object.ID, Object: object}
+}
+
+// ID returns the iri of the object whether it's embedded or not
+func (p *IRIOrObject) ID() string {
+	if p == nil {
+		return ""
+	}
+	if p.Object != nil && p.Object.ID != "" {
+		return p.Object.ID
+	}
+	return p.IRI
+}
+
+// UnmarshalJSON accepts an iri, an object or an array of them in
+// which case only the first one is kept
+func (p *IRIOrObject) UnmarshalJSON(b []byte) error {
+	switch firstByte(b) {
+	case '"':
+		return json.Unmarshal(b, &p.IRI)
+	case '{':
+		p.Object = &Object{}
+		err := json.Unmarshal(b, p.Object)
+		p.IRI = p.Object.ID
+		return err
+	case '[':
+		var all []IRIOrObject
+		err := json.Unmarshal(b, &all)
+		if err != nil || len(all) == 0 {
+			return err
+		}
+		*p = all[0]
+	}
+	return nil
+}
+
+// MarshalJSON writes the embedded object if there is one or the iri
+func (p IRIOrObject) MarshalJSON() ([]byte, error) {
+	if p.Object != nil {
+		return json.Marshal(p.Object)
+	}
+	return json.Marshal(p.IRI)
+}
+
+// ContentWarning returns the summary (used as a content warning) and
+// the sensitive flag of an object, or of the object of an activity like
+// the Creates OnReceiveContent gets
+func (o *Object) ContentWarning() (summary string, sensitive bool) {
+	if o.Summary == "" && !o.Sensitive && o.Object != nil && o.Object.Object != nil {
+		return o.Object.Object.ContentWarning()
+	}
+	return o.Summary, o.Sensitive
+}
+
+// Objects is a property that holds one or more objects, like `attachment`
+type Objects []*Object
+
+// UnmarshalJSON accepts an iri, an object or an array of them. Iris are
+// kept as objects with just an id
+func (o *Objects) UnmarshalJSON(b []byte) error {
+	var all []IRIOrObject
+	if firstByte(b) == '[' {
+		err := json.Unmarshal(b, &all)
+		if err != nil {
+			return err
+		}
+	} else {
+		var one IRIOrObject
+		err := json.Unmarshal(b, &one)
+		if err != nil {
+			return err
+		}
+		all = append(all, one)
+	}
+	*o = nil
+	for _, p := range all {
+		if p.Object == nil {
+			p.Object = &Object{ID: p.IRI}
+		}
+		*o = append(*o, p.Object)
+	}
+	return nil
+}
+
+// Strings is a property that can be either a single string or an array
+// of them, like `to` or `url`. Embedded objects or links in it are reduced
+// to their id or href.
+type Strings []string
+
+// UnmarshalJSON accepts a string, an object or an array of them
+func (s *Strings) UnmarshalJSON(b []byte) error {
+	var value interface{}
+	err := json.Unmarshal(b, &value)
+	if err != nil {
+		return err
+	}
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	*s = nil
+	for _, v := range values {
+		if iri := iriOrHref(v); iri != "" {
+			*s = append(*s, iri)
+		}
+	}
+	return nil
+}
+
+// MarshalJSON writes a single string if there is only one
+func (s Strings) MarshalJSON() ([]byte, error) {
+	if len(s) == 1 {
+		return json.Marshal(s[0])
+	}
+	return json.Marshal([]string(s))
+}
+
+// Contains tells whether the value is among the strings
+func (s Strings) Contains(value string) bool {
+	return containsString(s, value)
+}
+
+// Link is a reference to a resource, used for things like mentions
+// and hashtags in the tag property of an object
+type Link struct {
+	Type      string `json:"type,omitempty"`
+	Href      string `json:"href,omitempty"`
+	Name      string `json:"name,omitempty"`
+	MediaType string `json:"mediaType,omitempty"`
+
+	// Raw holds all the properties of the link as we received them
+	Raw map[string]interface{} `json:"-"`
+	// unread are the properties in Raw we couldn't read into their field
+	unread []string
+}
+
+// UnmarshalJSON accepts a link object or just its href
+func (l *Link) UnmarshalJSON(b []byte) error {
+	if firstByte(b) == '"' {
+		return json.Unmarshal(b, &l.Href)
+	}
+	type link Link
+	var err error
+	l.unread, err = unmarshalLenient(b, (*link)(l))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &l.Raw)
+}
+
+// MarshalJSON writes the link along with any unknown properties in Raw
+func (l Link) MarshalJSON() ([]byte, error) {
+	type link Link
+	return marshalWithRaw(link(l), l.Raw, l.unread)
+}
+
+// Links is a property that holds one or more links
+type Links []Link
+
+// UnmarshalJSON accepts a single link or an array of them
+func (l *Links) UnmarshalJSON(b []byte) error {
+	if firstByte(b) != '[' {
+		var link Link
+		err := json.Unmarshal(b, &link)
+		if err != nil {
+			return err
+		}
+		*l = Links{link}
+		return nil
+	}
+	return json.Unmarshal(b, (*[]Link)(l))
+}
+
+// contains tells whether there's a link of the same type to the same
+// href, or with the same name for links without one (e.g. hashtags)
+func (l Links) contains(link Link) bool {
+	for _, existing := range l {
+		if existing.Type == link.Type && existing.Href == link.Href &&
+			(link.Href != "" || strings.EqualFold(existing.Name, link.Name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Collection is an (Ordered)Collection or one of its pages
+type Collection struct {
+	Context      interface{}    `json:"@context,omitempty"`
+	ID           string         `json:"id,omitempty"`
+	Type         string         `json:"type,omitempty"`
+	TotalItems   int            `json:"totalItems"`
+	First        *IRIOrObject   `json:"first,omitempty"`
+	Last         *IRIOrObject   `json:"last,omitempty"`
+	Next         *IRIOrObject   `json:"next,omitempty"`
+	Prev         *IRIOrObject   `json:"prev,omitempty"`
+	PartOf       *IRIOrObject   `json:"partOf,omitempty"`
+	Items        []*IRIOrObject `json:"items,omitempty"`
+	OrderedItems []*IRIOrObject `json:"orderedItems,omitempty"`
+
+	// Raw holds all the properties of the collection as we received them
+	Raw map[string]interface{} `json:"-"`
+	// unread are the properties in Raw we couldn't read into their field
+	unread []string
+}
+
+// UnmarshalJSON reads the known properties in the fields of the
+// collection and keeps all of them in Raw. A collection we only
+// have the iri of ends up with just its id
+func (c *Collection) UnmarshalJSON(b []byte) error {
+	if firstByte(b) == '"' {
+		return json.Unmarshal(b, &c.ID)
+	}
+	type collection Collection
+	var err error
+	c.unread, err = unmarshalLenient(b, (*collection)(c))
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, &c.Raw)
+}
+
+// MarshalJSON writes the fields of the collection along with any
+// unknown properties we have in Raw
+func (c Collection) MarshalJSON() ([]byte, error) {
+	type collection Collection
+	return marshalWithRaw(collection(c), c.Raw, c.unread)
+}
+
+// unmarshalLenient reads the json object in b into the fields of the
+// struct v points to. Servers out there send all kinds of shapes for the
+// same property, so a property we can't read into its field leaves the
+// field empty instead of failing the whole object (it's still in Raw).
+// It returns the names of these properties
+func unmarshalLenient(b []byte, v interface{}) (unread []string, err error) {
+	var properties map[string]json.RawMessage
+	err = json.Unmarshal(b, &properties)
+	if err != nil {
+		return nil, err
+	}
+	s := reflect.ValueOf(v).Elem()
+	for i := 0; i < s.NumField(); i++ {
+		name := strings.Split(s.Type().Field(i).Tag.Get("json"), ",")[0]
+		value, ok := properties[name]
+		if !ok || name == "" || name == "-" {
+			continue
+		}
+		field := s.Field(i)
+		if json.Unmarshal(value, field.Addr().Interface()) != nil {
+			field.Set(reflect.Zero(field.Type()))
+			if !coerce(value, field) {
+				unread = append(unread, name)
+			}
+		}
+	}
+	return unread, nil
+}
+
+// coerce fills a field from a property that doesn't have the type we
+// expect when there's an obvious way to, e.g. "type": ["Create"] or
+// "width": "100". It tells whether it could
+func coerce(b []byte, field reflect.Value) bool {
+	var value interface{}
+	if json.Unmarshal(b, &value) != nil {
+		return false
+	}
+	if values, ok := value.([]interface{}); ok && len(values) > 0 {
+		value = values[0]
+	}
+	switch field.Kind() {
+	case reflect.String:
+		if s, ok := value.(string); ok {
+			field.SetString(s)
+			return true
+		}
+	case reflect.Int:
+		switch v := value.(type) {
+		case float64:
+			field.SetInt(int64(v))
+			return true
+		case string:
+			if n, err := strconv.Atoi(v); err == nil {
+				field.SetInt(int64(n))
+				return true
+			}
+		}
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			field.SetBool(v)
+			return true
+		case string:
+			if b, err := strconv.ParseBool(v); err == nil {
+				field.SetBool(b)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// marshalWithRaw marshals v and adds to it the properties in raw that
+// don't correspond to any of the fields of v, or that we couldn't read
+// (unread) into a field that is still empty
+func marshalWithRaw(v interface{}, raw map[string]interface{}, unread []string) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil || len(raw) == 0 {
+		return b, err
+	}
+	known := jsonFields(reflect.TypeOf(v))
+	m := make(map[string]interface{})
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		return nil, err
+	}
+	for k, value := range raw {
+		if _, set := m[k]; !known[k] || (!set && containsString(unread, k)) {
+			m[k] = value
+		}
+	}
+	return json.Marshal(m)
+}
+
+var jsonFieldsCache sync.Map
+
+// jsonFields returns the json names of the fields of a struct type
+func jsonFields(t reflect.Type) map[string]bool {
+	if fields, ok := jsonFieldsCache.Load(t); ok {
+		return fields.(map[string]bool)
+	}
+	fields := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = true
+		}
+	}
+	jsonFieldsCache.Store(t, fields)
+	return fields
+}
+
+// iriOrHref returns the id of an object, the href of a link or
+// the string itself
+func iriOrHref(value interface{}) string {
+	if m, ok := value.(map[string]interface{}); ok {
+		if href, ok := m["href"].(string); ok && m["id"] == nil {
+			return href
+		}
+	}
+	return iriOf(value)
+}
+
+// firstByte returns the first non whitespace byte of some json
+func firstByte(b []byte) byte {
+	for _, c := range b {
+		switch c {
+		case ' ', '\t', '\n', '\r':
+			continue
+		}
+		return c
+	}
+	return 0
+}
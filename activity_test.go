@@ -0,0 +1,117 @@
+package activityserve
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestUnmarshalRealActivities(t *testing.T) {
+	tests := []struct {
+		file        string
+		typ         string
+		actor       string
+		objectType  string
+		content     bool
+		attachments int
+		width       int
+		tags        int
+		// a property we don't have a field for that must survive
+		extra string
+	}{
+		{"mastodon_create.json", "Create", "https://mastodon.example/users/bob", "Note", true, 1, 1200, 3, "conversation"},
+		{"mastodon_update_person.json", "Update", "https://mastodon.example/users/bob", "Person", false, 1, 0, 0, "publicKey"},
+		{"pleroma_create.json", "Create", "https://pleroma.example/users/carol", "Note", true, 1, 0, 1, "context"},
+		{"pixelfed_create.json", "Create", "https://pixelfed.example/users/dan", "Note", true, 1, 1080, 1, "capabilities"},
+		{"odd_shapes.json", "Create", "https://odd.example/users/erin", "Note", true, 1, 100, 1, "name"},
+	}
+	for _, test := range tests {
+		t.Run(test.file, func(t *testing.T) {
+			b, err := os.ReadFile(filepath.Join("testdata", test.file))
+			if err != nil {
+				t.Fatal(err)
+			}
+			activity := &Activity{}
+			err = json.Unmarshal(b, activity)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if activity.Type != test.typ || activity.Actor.ID() != test.actor {
+				t.Fatalf("got a %s by %s", activity.Type, activity.Actor.ID())
+			}
+			if activity.Object == nil || activity.Object.Object == nil {
+				t.Fatal("the object is missing")
+			}
+			object := activity.Object.Object
+			if object.Type != test.objectType {
+				t.Errorf("got a %s object", object.Type)
+			}
+			if (object.Content != "") != test.content {
+				t.Errorf("got content %q", object.Content)
+			}
+			if len(object.Attachment) != test.attachments {
+				t.Fatalf("got %d attachments", len(object.Attachment))
+			}
+			if test.attachments > 0 && object.Attachment[0].Width != test.width {
+				t.Errorf("got width %d", object.Attachment[0].Width)
+			}
+			if len(object.Tag) != test.tags {
+				t.Errorf("got %d tags", len(object.Tag))
+			}
+
+			// what we pass on keeps what we couldn't read
+			out, err := json.Marshal(object)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var m map[string]interface{}
+			err = json.Unmarshal(out, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := m[test.extra]; !ok {
+				t.Errorf("%s was lost: %s", test.extra, out)
+			}
+		})
+	}
+}
+
+func TestUnmarshalOddShapes(t *testing.T) {
+	b, err := os.ReadFile(filepath.Join("testdata", "odd_shapes.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	activity := &Activity{}
+	err = json.Unmarshal(b, activity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := activity.Object.Object
+	if note.Name != "" {
+		t.Errorf("got name %q from a map", note.Name)
+	}
+	if !note.Sensitive {
+		t.Error("sensitive \"true\" was read as false")
+	}
+	if !note.AttributedTo.Contains("https://odd.example/users/erin") {
+		t.Errorf("got attributedTo %v", note.AttributedTo)
+	}
+	if note.Attachment[0].Height != 75 {
+		t.Errorf("got height %d", note.Attachment[0].Height)
+	}
+	if note.Tag[0].Name != "#odd" {
+		t.Errorf("got tag name %q", note.Tag[0].Name)
+	}
+	if note.Replies.TotalItems != 3 {
+		t.Errorf("got %d replies", note.Replies.TotalItems)
+	}
+
+	// but what isn't an object at all is still an error
+	for _, b := range []string{`"Create"`, `["Create"]`, `{"type": "Create",`} {
+		err = json.Unmarshal([]byte(b), &Activity{})
+		if err == nil {
+			t.Errorf("%s was read as an activity", b)
+		}
+	}
+}
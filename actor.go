@@ -8,9 +8,9 @@ import (
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gologme/log"
@@ -28,19 +28,41 @@ import (
 // Actor represents a local actor we can act on
 // behalf of.
 type Actor struct {
-	Name, summary, actorType, iri  string
-	followersIRI                   string
-	nuIri                          *url.URL
+	Name, summary, actorType, iri string
+	followersIRI                  string
+	nuIri                         *url.URL
+	*actorState
+	posts            map[int]map[string]interface{}
+	publicKey        crypto.PublicKey
+	privateKey       crypto.PrivateKey
+	publicKeyPem     string
+	privateKeyPem    string
+	publicKeyID      string
+	OnFollow         func(*Activity)
+	OnFollowRequest  func(*Activity)
+	OnUnfollow       func(*Activity)
+	OnReceiveContent func(*Activity)
+	OnDelete         func(*Activity)
+	OnUpdate         func(*Activity)
+	OnMove           func(*Activity)
+	instance         *Instance
+}
+
+// actorState is the part of an actor that changes as it federates. Actors
+// are passed around by value, so all the copies of an actor (the one the
+// application holds, the ones the handlers load etc.) share the same state
+// through the instance, and mu keeps concurrent requests from stepping on
+// each other. Hold mu to touch any of the fields
+type actorState struct {
+	mu                             sync.Mutex
 	followers, following, rejected map[string]interface{}
 	requested                      map[string]interface{}
-	posts                          map[int]map[string]interface{}
-	publicKey                      crypto.PublicKey
-	privateKey                     crypto.PrivateKey
-	publicKeyPem                   string
-	privateKeyPem                  string
-	publicKeyID                    string
-	OnFollow                       func(map[string]interface{})
-	OnReceiveContent               func(map[string]interface{})
+	sharedInboxes                  map[string]interface{}
+	followIDs                      map[string]interface{}
+	pending                        map[string]interface{}
+	manuallyApprovesFollowers      bool
+	alsoKnownAs                    []string
+	movedTo                        string
 }
 
 // ActorToSave is a stripped down actor representation
@@ -50,40 +72,63 @@ type Actor struct {
 type ActorToSave struct {
 	Name, Summary, ActorType, IRI, PublicKey, PrivateKey string
 	Followers, Following, Rejected, Requested            map[string]interface{}
+	SharedInboxes, FollowIDs, Pending                    map[string]interface{}
+	ManuallyApprovesFollowers                            bool
+	AlsoKnownAs                                          []string
+	MovedTo                                              string
 }
 
 // MakeActor creates and returns a new local actor we can act
 // on behalf of. It also creates its files on disk
 func MakeActor(name, summary, actorType string) (Actor, error) {
+	return defaultInstance.MakeActor(name, summary, actorType)
+}
+
+// MakeActor creates and returns a new local actor living on the instance
+func (i *Instance) MakeActor(name, summary, actorType string) (Actor, error) {
 	followers := make(map[string]interface{})
 	following := make(map[string]interface{})
 	rejected := make(map[string]interface{})
 	requested := make(map[string]interface{})
-	followersIRI := baseURL + name + "/followers"
-	publicKeyID := baseURL + name + "#main-key"
-	iri := baseURL + name
+	sharedInboxes := make(map[string]interface{})
+	followIDs := make(map[string]interface{})
+	pending := make(map[string]interface{})
+	followersIRI := i.baseURL + name + "/peers/followers"
+	publicKeyID := i.baseURL + name + "#main-key"
+	iri := i.baseURL + name
 	nuIri, err := url.Parse(iri)
 	if err != nil {
 		log.Info("Something went wrong when parsing the local actor uri into net/url")
 		return Actor{}, err
 	}
 	actor := Actor{
-		Name:         name,
-		summary:      summary,
-		actorType:    actorType,
-		iri:          iri,
-		nuIri:        nuIri,
-		followers:    followers,
-		following:    following,
-		rejected:     rejected,
-		requested:    requested,
+		Name:      name,
+		summary:   summary,
+		actorType: actorType,
+		iri:       iri,
+		nuIri:     nuIri,
+		actorState: i.actorState(name, &actorState{
+			followers:     followers,
+			following:     following,
+			rejected:      rejected,
+			requested:     requested,
+			sharedInboxes: sharedInboxes,
+			followIDs:     followIDs,
+			pending:       pending,
+		}, true),
 		followersIRI: followersIRI,
 		publicKeyID:  publicKeyID,
+		instance:     i,
 	}
 
 	// set auto accept by default (this could be a configuration value)
-	actor.OnFollow = func(activity map[string]interface{}) { actor.Accept(activity) }
-	actor.OnReceiveContent = func(activity map[string]interface{}) {}
+	actor.OnFollow = func(activity *Activity) { actor.Accept(activity) }
+	actor.OnFollowRequest = func(activity *Activity) {}
+	actor.OnUnfollow = func(activity *Activity) {}
+	actor.OnReceiveContent = func(activity *Activity) {}
+	actor.OnDelete = func(activity *Activity) {}
+	actor.OnUpdate = func(activity *Activity) {}
+	actor.OnMove = func(activity *Activity) {}
 
 	// create actor's keypair
 	rng := rand.Reader
@@ -119,6 +164,8 @@ func MakeActor(name, summary, actorType string) (Actor, error) {
 	if err != nil {
 		return actor, err
 	}
+	// an actor made again under the same name has new keys
+	i.forgetSigningKey(name)
 
 	return actor, nil
 }
@@ -130,37 +177,38 @@ func (a *Actor) GetOutboxIRI() *url.URL {
 	return nuiri
 }
 
-// LoadActor searches the filesystem and creates an Actor
-// from the data in <name>.json
+// LoadActor searches the storage and creates an Actor
+// from the data we have saved for it
 // This does not preserve events so use with caution
 func LoadActor(name string) (Actor, error) {
+	return defaultInstance.LoadActor(name)
+}
+
+// LoadActor loads an actor of the instance from storage
+func (i *Instance) LoadActor(name string) (Actor, error) {
 	// make sure our users can't read our hard drive
 	if strings.ContainsAny(name, "./ ") {
 		log.Info("Illegal characters in actor name")
 		return Actor{}, errors.New("Illegal characters in actor name")
 	}
-	jsonFile := storage + slash + "actors" + slash + name + slash + name + ".json"
-	fileHandle, err := os.Open(jsonFile)
-	if os.IsNotExist(err) {
+	saved, err := i.store.LoadActor(name)
+	if err == ErrNotFound {
 		log.Info(name)
 		log.Info("We don't have this kind of actor stored")
 		return Actor{}, err
 	}
-	byteValue, err := ioutil.ReadAll(fileHandle)
 	if err != nil {
 		log.Info("Error reading actor file")
 		return Actor{}, err
 	}
-	jsonData := make(map[string]interface{})
-	json.Unmarshal(byteValue, &jsonData)
 
-	nuIri, err := url.Parse(jsonData["IRI"].(string))
+	nuIri, err := url.Parse(saved.IRI)
 	if err != nil {
 		log.Info("Something went wrong when parsing the local actor uri into net/url")
 		return Actor{}, err
 	}
 
-	publicKeyDecoded, rest := pem.Decode([]byte(jsonData["PublicKey"].(string)))
+	publicKeyDecoded, rest := pem.Decode([]byte(saved.PublicKey))
 	if publicKeyDecoded == nil {
 		log.Info(rest)
 		panic("failed to parse PEM block containing the public key")
@@ -171,7 +219,7 @@ func LoadActor(name string) (Actor, error) {
 		log.Info(err)
 		return Actor{}, err
 	}
-	privateKeyDecoded, rest := pem.Decode([]byte(jsonData["PrivateKey"].(string)))
+	privateKeyDecoded, rest := pem.Decode([]byte(saved.PrivateKey))
 	if privateKeyDecoded == nil {
 		log.Info(rest)
 		panic("failed to parse PEM block containing the private key")
@@ -184,25 +232,41 @@ func LoadActor(name string) (Actor, error) {
 	}
 
 	actor := Actor{
-		Name:          name,
-		summary:       jsonData["Summary"].(string),
-		actorType:     jsonData["ActorType"].(string),
-		iri:           jsonData["IRI"].(string),
-		nuIri:         nuIri,
-		followers:     jsonData["Followers"].(map[string]interface{}),
-		following:     jsonData["Following"].(map[string]interface{}),
-		rejected:      jsonData["Rejected"].(map[string]interface{}),
-		requested:     jsonData["Requested"].(map[string]interface{}),
+		Name:      name,
+		summary:   saved.Summary,
+		actorType: saved.ActorType,
+		iri:       saved.IRI,
+		nuIri:     nuIri,
+		// if the actor is loaded already it shares the state of the
+		// other copies, which is at least as recent as the saved one
+		actorState: i.actorState(name, &actorState{
+			followers:                 nonNil(saved.Followers),
+			following:                 nonNil(saved.Following),
+			rejected:                  nonNil(saved.Rejected),
+			requested:                 nonNil(saved.Requested),
+			sharedInboxes:             nonNil(saved.SharedInboxes),
+			followIDs:                 nonNil(saved.FollowIDs),
+			pending:                   nonNil(saved.Pending),
+			manuallyApprovesFollowers: saved.ManuallyApprovesFollowers,
+			alsoKnownAs:               saved.AlsoKnownAs,
+			movedTo:                   saved.MovedTo,
+		}, false),
 		publicKey:     publicKey,
 		privateKey:    privateKey,
-		publicKeyPem:  jsonData["PublicKey"].(string),
-		privateKeyPem: jsonData["PrivateKey"].(string),
-		followersIRI:  baseURL + name + "/followers",
-		publicKeyID:   baseURL + name + "#main-key",
+		publicKeyPem:  saved.PublicKey,
+		privateKeyPem: saved.PrivateKey,
+		followersIRI:  i.baseURL + name + "/peers/followers",
+		publicKeyID:   i.baseURL + name + "#main-key",
+		instance:      i,
 	}
 
-	actor.OnFollow = func(activity map[string]interface{}) { actor.Accept(activity) }
-	actor.OnReceiveContent = func(activity map[string]interface{}) {}
+	actor.OnFollow = func(activity *Activity) { actor.Accept(activity) }
+	actor.OnFollowRequest = func(activity *Activity) {}
+	actor.OnUnfollow = func(activity *Activity) {}
+	actor.OnReceiveContent = func(activity *Activity) {}
+	actor.OnDelete = func(activity *Activity) {}
+	actor.OnUpdate = func(activity *Activity) {}
+	actor.OnMove = func(activity *Activity) {}
 
 	return actor, nil
 }
@@ -210,11 +274,17 @@ func LoadActor(name string) (Actor, error) {
 // GetActor attempts to LoadActor and if it doesn't exist
 // creates one
 func GetActor(name, summary, actorType string) (Actor, error) {
-	actor, err := LoadActor(name)
+	return defaultInstance.GetActor(name, summary, actorType)
+}
+
+// GetActor loads an actor of the instance, creating it if it
+// doesn't exist
+func (i *Instance) GetActor(name, summary, actorType string) (Actor, error) {
+	actor, err := i.LoadActor(name)
 
 	if err != nil {
 		log.Info("Actor doesn't exist, creating...")
-		actor, err = MakeActor(name, summary, actorType)
+		actor, err = i.MakeActor(name, summary, actorType)
 		if err != nil {
 			log.Info("Can't create actor!")
 			return Actor{}, err
@@ -244,75 +314,78 @@ func GetActor(name, summary, actorType string) (Actor, error) {
 // TODO, this should parse the iri and load the right actor
 // }
 
-// save the actor to file
+// save the actor to storage
 func (a *Actor) save() error {
-
-	// check if we already have a directory to save actors
-	// and if not, create it
-	dir := storage + slash + "actors" + slash + a.Name + slash + "items"
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, 0755)
-	}
-
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	actorToSave := ActorToSave{
-		Name:       a.Name,
-		Summary:    a.summary,
-		ActorType:  a.actorType,
-		IRI:        a.iri,
-		Followers:  a.followers,
-		Following:  a.following,
-		Rejected:   a.rejected,
-		Requested:  a.requested,
-		PublicKey:  a.publicKeyPem,
-		PrivateKey: a.privateKeyPem,
+		Name:                      a.Name,
+		Summary:                   a.summary,
+		ActorType:                 a.actorType,
+		IRI:                       a.iri,
+		Followers:                 a.followers,
+		Following:                 a.following,
+		Rejected:                  a.rejected,
+		Requested:                 a.requested,
+		SharedInboxes:             a.sharedInboxes,
+		FollowIDs:                 a.followIDs,
+		Pending:                   a.pending,
+		ManuallyApprovesFollowers: a.manuallyApprovesFollowers,
+		AlsoKnownAs:               a.alsoKnownAs,
+		MovedTo:                   a.movedTo,
+		PublicKey:                 a.publicKeyPem,
+		PrivateKey:                a.privateKeyPem,
 	}
 
-	actorJSON, err := json.MarshalIndent(actorToSave, "", "\t")
-	if err != nil {
-		log.Info("error Marshalling actor json")
-		return err
-	}
-	// log.Info(actorToSave)
-	// log.Info(string(actorJSON))
-	err = ioutil.WriteFile(storage+slash+"actors"+slash+a.Name+slash+a.Name+".json", actorJSON, 0644)
-	if err != nil {
-		log.Printf("WriteFileJson ERROR: %+v", err)
-		return err
-	}
-
-	return nil
+	return a.instance.store.SaveActor(&actorToSave)
 }
 
 func (a *Actor) whoAmI() string {
 
 	self := make(map[string]interface{})
-	self["@context"] = context()
+	self["@context"] = []interface{}{
+		"https://www.w3.org/ns/activitystreams",
+		map[string]interface{}{
+			"manuallyApprovesFollowers": "as:manuallyApprovesFollowers",
+			"alsoKnownAs":               map[string]string{"@id": "as:alsoKnownAs", "@type": "@id"},
+			"movedTo":                   map[string]string{"@id": "as:movedTo", "@type": "@id"},
+		},
+	}
 	self["type"] = a.actorType
-	self["id"] = baseURL + a.Name
+	self["id"] = a.instance.baseURL + a.Name
 	self["name"] = a.Name
 	self["preferredUsername"] = a.Name
 	self["summary"] = a.summary
-	self["inbox"] = baseURL + a.Name + "/inbox"
-	self["outbox"] = baseURL + a.Name + "/outbox"
-	self["followers"] = baseURL + a.Name + "/peers/followers"
-	self["following"] = baseURL + a.Name + "/peers/following"
+	self["inbox"] = a.instance.baseURL + a.Name + "/inbox"
+	self["outbox"] = a.instance.baseURL + a.Name + "/outbox"
+	self["followers"] = a.followersIRI
+	self["following"] = a.instance.baseURL + a.Name + "/peers/following"
 	self["publicKey"] = map[string]string{
-		"id":           baseURL + a.Name + "#main-key",
-		"owner":        baseURL + a.Name,
+		"id":           a.instance.baseURL + a.Name + "#main-key",
+		"owner":        a.instance.baseURL + a.Name,
 		"publicKeyPem": a.publicKeyPem,
 	}
+	a.mu.Lock()
+	self["manuallyApprovesFollowers"] = a.manuallyApprovesFollowers
+	if len(a.alsoKnownAs) > 0 {
+		self["alsoKnownAs"] = a.alsoKnownAs
+	}
+	if a.movedTo != "" {
+		self["movedTo"] = a.movedTo
+	}
+	a.mu.Unlock()
 	selfString, _ := json.Marshal(self)
 	return string(selfString)
 }
 
 func (a *Actor) newItemID() (hash string, url string) {
 	hash = uniuri.New()
-	return hash, baseURL + a.Name + "/item/" + hash
+	return hash, a.instance.baseURL + a.Name + "/item/" + hash
 }
 
 func (a *Actor) newID() (hash string, url string) {
 	hash = uniuri.New()
-	return hash, baseURL + a.Name + "/" + hash
+	return hash, a.instance.baseURL + a.Name + "/" + hash
 }
 
 // TODO Reply(content string, inReplyTo string)
@@ -321,80 +394,257 @@ func (a *Actor) newID() (hash string, url string) {
 // a post
 //TODO
 
-// DM sends a direct message to a user
-// TODO
+// NoteOptions are the optional settings of a note created
+// with CreateNoteWithOptions
+type NoteOptions struct {
+	// InReplyTo is the iri of the post we're replying to
+	InReplyTo string
+	// Visibility is who can see the note, public by default
+	Visibility Visibility
+	// Recipients are the iris of actors the note is addressed to
+	// explicitly. For direct notes they're the only ones that get it
+	Recipients []string
+	// Tag holds the mentions, hashtags etc. of the note
+	Tag Links
+	// Attachments are files uploaded with UploadMedia
+	Attachments []*Attachment
+	// Summary is the content warning shown in place of the content
+	Summary string
+	// Sensitive hides the attachments until they're clicked on. Notes
+	// with a Summary are always sensitive
+	Sensitive bool
+	// Source is the Markdown the content was written in, if any
+	Source string
+}
 
-// CreateNote posts an activityPub note to our followers
+// CreateNote posts a public activityPub note to our followers
 func (a *Actor) CreateNote(content, inReplyTo string) {
-	// for now I will just write this to the outbox
+	a.CreateNoteWithOptions(content, NoteOptions{InReplyTo: inReplyTo})
+}
+
+// CreateNoteWithOptions posts an activityPub note and returns its id.
+// @user@host mentions and #hashtags in the content are turned into links
+// and tags, and the mentioned actors get the note too
+func (a *Actor) CreateNoteWithOptions(content string, options NoteOptions) (string, error) {
+	return a.publish(&Note{Type: "Note", Content: content}, options)
+}
+
+// CreateArticle posts a public article and returns its id. url is the
+// permalink of its html version, summary a short description of it
+func (a *Actor) CreateArticle(title, content, summary, url string) (string, error) {
+	return a.CreateArticleWithOptions(title, content, summary, url, NoteOptions{})
+}
+
+// CreateArticleWithOptions posts an article like CreateNoteWithOptions
+// does notes. The summary of an article is not a content warning, one
+// can still be set in the options
+func (a *Actor) CreateArticleWithOptions(title, content, summary, url string, options NoteOptions) (string, error) {
+	article := &Article{Type: "Article", Name: title, Content: content, Summary: summary}
+	if url != "" {
+		article.URL = Strings{url}
+	}
+	return a.publish(article, options)
+}
+
+// publish fills in a new post (a Note, Question etc.) according to the
+// options, wraps it in a Create, stores it and delivers it
+func (a *Actor) publish(post *Object, options NoteOptions) (string, error) {
 	hash, id := a.newItemID()
-	create := make(map[string]interface{})
-	note := make(map[string]interface{})
-	create["@context"] = context()
-	create["actor"] = baseURL + a.Name
-	create["cc"] = a.followersIRI
-	create["id"] = id
-	create["object"] = note
-	note["attributedTo"] = baseURL + a.Name
-	note["cc"] = a.followersIRI
-	note["content"] = content
-	if inReplyTo != "" {
-		note["inReplyTo"] = inReplyTo
-	}
-	note["id"] = id
-	note["published"] = time.Now().Format(time.RFC3339)
-	note["url"] = create["id"]
-	note["type"] = "Note"
-	note["to"] = "https://www.w3.org/ns/activitystreams#Public"
-	create["published"] = note["published"]
-	create["type"] = "Create"
-	go a.sendToFollowers(create)
+	post.Tag = options.Tag
+	recipients := a.setContent(post, post.Content, options.Recipients)
+	to, cc := a.address(options.Visibility, recipients)
+	post.AttributedTo = Strings{a.instance.baseURL + a.Name}
+	post.To = to
+	post.CC = cc
+	if options.Summary != "" {
+		post.Summary = options.Summary
+	}
+	post.Sensitive = options.Sensitive || options.Summary != ""
+	if options.Source != "" {
+		post.Source = &Source{Content: options.Source, MediaType: "text/markdown"}
+	}
+	post.ID = id
+	post.Published = time.Now().Format(time.RFC3339)
+	// posts that live somewhere else in html (e.g. articles) point there
+	if len(post.URL) == 0 {
+		post.URL = Strings{id}
+	}
+	post.Attachment = options.Attachments
+	if options.InReplyTo != "" {
+		post.InReplyTo = NewIRI(options.InReplyTo)
+	}
+	create := &Activity{
+		Context:   noteContext(),
+		Actor:     NewIRI(a.instance.baseURL + a.Name),
+		To:        to,
+		CC:        cc,
+		ID:        id,
+		Object:    Embed(post),
+		Published: post.Published,
+		Type:      "Create",
+	}
 	err := a.saveItem(hash, create)
 	if err != nil {
-		log.Info("Could not save note to disk")
+		log.Info("Could not save " + post.Type + " to storage")
+		return "", err
 	}
-	err = a.appendToOutbox(id)
-	if err != nil {
-		log.Info("Could not append Note to outbox.txt")
+	// direct posts are nobody else's business
+	if options.Visibility != VisibilityDirect {
+		err = a.appendToOutbox(id)
+		if err != nil {
+			log.Info("Could not append " + post.Type + " to the outbox")
+		}
+		a.sendToFollowers(create)
 	}
+	a.sendToRecipients(create, recipients, options.Visibility != VisibilityDirect)
+	return id, nil
 }
 
-// saveItem saves an activity to disk under the actor and with the id as
-// filename
-func (a *Actor) saveItem(hash string, content map[string]interface{}) error {
-	JSON, _ := json.MarshalIndent(content, "", "\t")
+// setContent sets the content of a post with its mentions and hashtags
+// turned into links and added to its tags. It returns the recipients
+// with the mentioned actors added
+func (a *Actor) setContent(post *Object, content string, recipients []string) []string {
+	content, tags, mentioned := a.parseContent(content)
+	for _, tag := range tags {
+		if !post.Tag.contains(tag) {
+			post.Tag = append(post.Tag, tag)
+		}
+	}
+	for _, iri := range mentioned {
+		if !containsString(recipients, iri) {
+			recipients = append(recipients, iri)
+		}
+	}
+	post.Content = content
+	return recipients
+}
 
-	dir := storage + slash + "actors" + slash + a.Name + slash + "items"
-	err := ioutil.WriteFile(dir+slash+hash+".json", JSON, 0644)
-	if err != nil {
-		log.Printf("WriteFileJson ERROR: %+v", err)
-		return err
+// itemHash returns the hash of one of our items given either its
+// iri or the hash itself
+func (a *Actor) itemHash(id string) (string, error) {
+	hash := strings.TrimPrefix(id, a.iri+"/item/")
+	if hash == "" || strings.ContainsAny(hash, "/") {
+		return "", errors.New(id + " is not one of our items")
 	}
-	return nil
+	return hash, nil
 }
 
-func (a *Actor) loadItem(hash string) (item map[string]interface{}, err error) {
-	dir := storage + slash + "actors" + slash + a.Name + slash + "items"
-	jsonFile := dir + slash + hash + ".json"
-	fileHandle, err := os.Open(jsonFile)
-	if os.IsNotExist(err) {
-		log.Info("We don't have this item stored")
+// loadPost loads the Create activity of one of our posts
+func (a *Actor) loadPost(id string) (hash string, create *Activity, err error) {
+	hash, err = a.itemHash(id)
+	if err != nil {
+		return
+	}
+	item, err := a.loadItem(hash)
+	if err != nil {
 		return
 	}
-	byteValue, err := ioutil.ReadAll(fileHandle)
+	create, err = objectFromMap(item)
 	if err != nil {
-		log.Info("Error reading item file")
 		return
 	}
-	json.Unmarshal(byteValue, &item)
+	if create.Type != "Create" || create.Object == nil || create.Object.Object == nil {
+		return hash, nil, errors.New(id + " is not a post")
+	}
+	return hash, create, nil
+}
 
+// UpdateNote changes the content of one of our notes and sends the new
+// version to everybody who got it. Like when posting, mentions and
+// hashtags are turned into links and the actors mentioned get it too
+func (a *Actor) UpdateNote(id, content string) error {
+	hash, create, err := a.loadPost(id)
+	if err != nil {
+		return err
+	}
+	note := create.Object.Object
+	visibility := a.visibilityOf(note)
+	recipients := a.setContent(note, content, a.recipientsOf(note))
+	note.To, note.CC = a.address(visibility, recipients)
+	create.To, create.CC = note.To, note.CC
+	note.Updated = time.Now().Format(time.RFC3339)
+	err = a.saveItem(hash, create)
+	if err != nil {
+		log.Info("Could not save note to storage")
+		return err
+	}
+	return a.sendToAudience(a.newUpdate(note), note, nil)
+}
+
+// newUpdate returns an Update activity carrying the new version of one
+// of our posts
+func (a *Actor) newUpdate(post *Object) *Activity {
+	_, updateID := a.newID()
+	return &Activity{
+		Context:   noteContext(),
+		Actor:     NewIRI(a.iri),
+		ID:        updateID,
+		Type:      "Update",
+		Object:    Embed(post),
+		To:        post.To,
+		CC:        post.CC,
+		Published: time.Now().Format(time.RFC3339),
+	}
+}
+
+// DeletePost replaces one of our posts with a Tombstone, removes it
+// from our outbox and tells everybody who got it to delete it
+func (a *Actor) DeletePost(id string) error {
+	hash, create, err := a.loadPost(id)
+	if err != nil {
+		return err
+	}
+	post := create.Object.Object
+	tombstone := &Tombstone{
+		Context:    context(),
+		ID:         post.ID,
+		Type:       "Tombstone",
+		FormerType: post.Type,
+		Deleted:    time.Now().Format(time.RFC3339),
+	}
+	err = a.saveItem(hash, tombstone)
+	if err != nil {
+		log.Info("Could not save tombstone to storage")
+		return err
+	}
+	err = a.instance.store.RemoveFromOutbox(a.Name, create.ID)
+	if err != nil {
+		log.Info("Could not remove the post from the outbox")
+		return err
+	}
+
+	_, deleteID := a.newID()
+	tombstone.Context = nil
+	del := &Activity{
+		Context: context(),
+		Actor:   NewIRI(a.iri),
+		ID:      deleteID,
+		Type:    "Delete",
+		Object:  Embed(tombstone),
+		To:      post.To,
+		CC:      post.CC,
+	}
+	return a.sendToAudience(del, post, nil)
+}
+
+// saveItem saves an activity to storage under the actor and with the
+// hash as key
+func (a *Actor) saveItem(hash string, content interface{}) error {
+	return a.instance.store.SaveItem(a.Name, hash, content)
+}
+
+func (a *Actor) loadItem(hash string) (item map[string]interface{}, err error) {
+	item, err = a.instance.store.LoadItem(a.Name, hash)
+	if err == ErrNotFound {
+		log.Info("We don't have this item stored")
+	}
 	return
 }
 
 // send is here for backward compatibility and maybe extra pre-processing
 // not always required
-func (a *Actor) send(content map[string]interface{}, to *url.URL) (err error) {
-	return a.signedHTTPPost(content, to.String())
+func (a *Actor) send(content interface{}, to *url.URL) (err error) {
+	return a.deliver(content, to.String())
 }
 
 // getPeers gets followers or following depending on `who`
@@ -403,6 +653,8 @@ func (a *Actor) getPeers(page int, who string) (response []byte, err error) {
 	// OrderedCollection with info of where to find orderedCollectionPages
 	// with the actual information. We are mirroring that behavior
 
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	var collection map[string]interface{}
 	if who == "followers" {
 		collection = a.followers
@@ -411,25 +663,24 @@ func (a *Actor) getPeers(page int, who string) (response []byte, err error) {
 	} else {
 		return nil, errors.New("cannot find collection" + who)
 	}
-	themap := make(map[string]interface{})
-	themap["@context"] = context()
+	peers := &Collection{Context: context()}
 	if page == 0 {
-		themap["first"] = baseURL + a.Name + "/peers/" + who + "?page=1"
-		themap["id"] = baseURL + a.Name + "/peers/" + who
-		themap["totalItems"] = strconv.Itoa(len(collection))
-		themap["type"] = "OrderedCollection"
+		peers.First = NewIRI(a.instance.baseURL + a.Name + "/peers/" + who + "?page=1")
+		peers.ID = a.instance.baseURL + a.Name + "/peers/" + who
+		peers.TotalItems = len(collection)
+		peers.Type = "OrderedCollection"
 	} else if page == 1 { // implement pagination
-		themap["id"] = baseURL + a.Name + who + "?page=" + strconv.Itoa(page)
-		items := make([]string, 0, len(collection))
+		peers.ID = a.instance.baseURL + a.Name + who + "?page=" + strconv.Itoa(page)
+		items := make([]*IRIOrObject, 0, len(collection))
 		for k := range collection {
-			items = append(items, k)
+			items = append(items, NewIRI(k))
 		}
-		themap["orderedItems"] = items
-		themap["partOf"] = baseURL + a.Name + "/peers/" + who
-		themap["totalItems"] = len(collection)
-		themap["type"] = "OrderedCollectionPage"
+		peers.OrderedItems = items
+		peers.PartOf = NewIRI(a.instance.baseURL + a.Name + "/peers/" + who)
+		peers.TotalItems = len(collection)
+		peers.Type = "OrderedCollectionPage"
 	}
-	response, _ = json.Marshal(themap)
+	response, _ = json.Marshal(peers)
 	return
 }
 
@@ -443,10 +694,26 @@ func (a *Actor) GetFollowing(page int) (response []byte, err error) {
 	return a.getPeers(page, "following")
 }
 
+// httpStatusError is returned when a remote server answers
+// our request with a non success status code
+type httpStatusError struct {
+	code int
+	msg  string
+}
+
+func (e *httpStatusError) Error() string {
+	return e.msg
+}
+
 // signedHTTPPost performs an HTTP post on behalf of Actor with the
 // request-target, date, host and digest headers signed
 // with the actor's private key.
-func (a *Actor) signedHTTPPost(content map[string]interface{}, to string) (err error) {
+func (a *Actor) signedHTTPPost(content interface{}, to string) (err error) {
+	return a.instance.signedHTTPPost(signingKey{id: a.publicKeyID, key: a.privateKey}, content, to)
+}
+
+// signedHTTPPost posts content to the inbox at to, signed with key
+func (i *Instance) signedHTTPPost(key signingKey, content interface{}, to string) (err error) {
 	b, err := json.Marshal(content)
 	if err != nil {
 		log.Info("Can't marshal JSON")
@@ -473,16 +740,16 @@ func (a *Actor) signedHTTPPost(content map[string]interface{}, to string) (err e
 	}
 	req.Header.Add("Accept-Charset", "utf-8")
 	req.Header.Add("Date", time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05")+" GMT")
-	req.Header.Add("User-Agent", userAgent+" "+version)
+	req.Header.Add("User-Agent", i.userAgent+" "+version)
 	req.Header.Add("Host", iri.Host)
 	req.Header.Add("Accept", "application/activity+json; charset=utf-8")
 	req.Header.Add("Content-Type", "application/activity+json; charset=utf-8")
-	err = postSigner.SignRequest(a.privateKey, a.publicKeyID, req, byteCopy)
+	err = postSigner.SignRequest(key.key, key.id, req, byteCopy)
 	if err != nil {
 		log.Info(err)
 		return
 	}
-	resp, err := client.Do(req)
+	resp, err := i.client.Do(req)
 	if err != nil {
 		log.Info(err)
 		return
@@ -490,7 +757,10 @@ func (a *Actor) signedHTTPPost(content map[string]interface{}, to string) (err e
 	defer resp.Body.Close()
 	if !isSuccess(resp.StatusCode) {
 		responseData, _ := ioutil.ReadAll(resp.Body)
-		err = fmt.Errorf("POST request to %s failed (%d): %s\nResponse: %s \nRequest: %s \nHeaders: %s", to, resp.StatusCode, resp.Status, FormatJSON(responseData), FormatJSON(byteCopy), FormatHeaders(req.Header))
+		err = &httpStatusError{
+			code: resp.StatusCode,
+			msg:  fmt.Sprintf("POST request to %s failed (%d): %s\nResponse: %s \nRequest: %s \nHeaders: %s", to, resp.StatusCode, resp.Status, FormatJSON(responseData), FormatJSON(byteCopy), FormatHeaders(req.Header)),
+		}
 		log.Info(err)
 		return
 	}
@@ -514,7 +784,7 @@ func (a *Actor) signedHTTPGet(address string) (string, error) {
 
 	req.Header.Add("Accept-Charset", "utf-8")
 	req.Header.Add("Date", time.Now().UTC().Format("Mon, 02 Jan 2006 15:04:05")+" GMT")
-	req.Header.Add("User-Agent", fmt.Sprintf("%s %s %s", userAgent, libName, version))
+	req.Header.Add("User-Agent", fmt.Sprintf("%s %s %s", a.instance.userAgent, libName, version))
 	req.Header.Add("host", iri.Host)
 	req.Header.Add("digest", "")
 	req.Header.Add("Accept", "application/activity+json; profile=\"https://www.w3.org/ns/activitystreams\"")
@@ -527,7 +797,7 @@ func (a *Actor) signedHTTPGet(address string) (string, error) {
 		return "", err
 	}
 
-	resp, err := client.Do(req)
+	resp, err := a.instance.client.Do(req)
 	if err != nil {
 		log.Error("Cannot perform the GET request")
 		log.Error(err)
@@ -548,91 +818,192 @@ func (a *Actor) signedHTTPGet(address string) (string, error) {
 }
 
 // NewFollower records a new follower to the actor file
-func (a *Actor) NewFollower(iri string, inbox string) error {
+// along with the shared inbox of their server, if it has one
+func (a *Actor) NewFollower(iri string, inbox string, sharedInbox string) error {
+	a.mu.Lock()
 	a.followers[iri] = inbox
+	if sharedInbox != "" {
+		a.sharedInboxes[iri] = sharedInbox
+	} else {
+		delete(a.sharedInboxes, iri)
+	}
+	a.mu.Unlock()
 	return a.save()
 }
 
-// appendToOutbox adds a new line with the id of the activity
-// to outbox.txt
+// appendToOutbox adds the id of the activity to the
+// actor's outbox
 func (a *Actor) appendToOutbox(iri string) (err error) {
-	// create outbox file if it doesn't exist
-	var outbox *os.File
-
-	outboxFilePath := storage + slash + "actors" + slash + a.Name + slash + "outbox.txt"
-	outbox, err = os.OpenFile(outboxFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	err = a.instance.store.AppendToOutbox(a.Name, iri)
 	if err != nil {
-		log.Info("Cannot create or open outbox file")
+		log.Info("Cannot append to the outbox")
 		log.Info(err)
-		return err
 	}
-	defer outbox.Close()
-
-	outbox.Write([]byte(iri + "\n"))
-
-	return nil
+	return err
 }
 
-// batchSend sends a batch of http posts to a list of recipients
-func (a *Actor) batchSend(activity map[string]interface{}, recipients []string) (err error) {
+// batchSend queues the delivery of an activity to a list of recipients
+func (a *Actor) batchSend(activity interface{}, recipients []string) (err error) {
 	for _, v := range recipients {
-		err := a.signedHTTPPost(activity, v)
+		err := a.deliver(activity, v)
 		if err != nil {
-			log.Info("Failed to deliver message to " + v)
+			log.Info("Failed to queue message to " + v)
 		}
 	}
 	return
 }
 
-// send to followers sends a batch of http posts to each one of the followers
-func (a *Actor) sendToFollowers(activity map[string]interface{}) (err error) {
-	recipients := make([]string, len(a.followers))
+// send to followers sends a batch of http posts to each one of the followers.
+// Followers that live on the same server and share an inbox get a single
+// delivery to that shared inbox
+func (a *Actor) sendToFollowers(activity interface{}) (err error) {
+	a.mu.Lock()
+	recipients := make([]string, 0, len(a.followers))
+	seen := make(map[string]bool)
 
-	i := 0
-	for _, inbox := range a.followers {
-		recipients[i] = inbox.(string)
-		i++
+	for follower, inbox := range a.followers {
+		recipient, _ := inbox.(string)
+		if sharedInbox, ok := a.sharedInboxes[follower].(string); ok && sharedInbox != "" {
+			recipient = sharedInbox
+		}
+		if recipient == "" || seen[recipient] {
+			continue
+		}
+		seen[recipient] = true
+		recipients = append(recipients, recipient)
 	}
+	a.mu.Unlock()
 	a.batchSend(activity, recipients)
 	return
 }
 
+// DirectMessage sends a note that only the recipients can see, mentioning
+// each of them. It's delivered to their inboxes only and it's kept out of
+// our outbox. It returns the id of the note
+func (a *Actor) DirectMessage(recipients []string, content string) (string, error) {
+	if len(recipients) == 0 {
+		return "", errors.New("a direct message needs at least one recipient")
+	}
+	mentions := make(Links, 0, len(recipients))
+	for _, recipient := range recipients {
+		remote, err := a.instance.NewRemoteActor(recipient)
+		if err != nil {
+			log.Info("Can't contact " + recipient)
+			return "", err
+		}
+		mentions = append(mentions, Link{Type: "Mention", Href: recipient, Name: remote.Handle()})
+	}
+	return a.CreateNoteWithOptions(content, NoteOptions{
+		Visibility: VisibilityDirect,
+		Recipients: recipients,
+		Tag:        mentions,
+	})
+}
+
+// sendToRecipients delivers an activity to the inbox of each of the
+// recipients. If it has already been sent to our followers the ones
+// that follow us are skipped
+func (a *Actor) sendToRecipients(activity interface{}, recipients []string, sentToFollowers bool) {
+	for _, recipient := range recipients {
+		if a.isFollower(recipient) && sentToFollowers {
+			continue
+		}
+		remote, err := a.instance.cachedRemoteActor(recipient)
+		if err != nil {
+			log.Info("Can't contact " + recipient + " to get their inbox")
+			continue
+		}
+		err = a.deliver(activity, remote.inbox)
+		if err != nil {
+			log.Info("Couldn't deliver to " + recipient)
+			log.Info(err)
+		}
+	}
+}
+
+// sendToAudience delivers an activity about one of our posts to the
+// ones it was addressed to, our followers only if they were among
+// them, and to the extra recipients
+func (a *Actor) sendToAudience(activity interface{}, post *Object, extra []string) (err error) {
+	recipients := a.recipientsOf(post)
+	for _, recipient := range extra {
+		if !containsString(recipients, recipient) {
+			recipients = append(recipients, recipient)
+		}
+	}
+
+	toFollowers := post.To.Contains(a.followersIRI) || post.CC.Contains(a.followersIRI)
+	if toFollowers {
+		err = a.sendToFollowers(activity)
+	}
+	a.sendToRecipients(activity, recipients, toFollowers)
+	return err
+}
+
+// recipientsOf returns the actors one of our posts is addressed to
+// explicitly, i.e. besides everybody and our followers
+func (a *Actor) recipientsOf(post *Object) []string {
+	var recipients []string
+	for _, audience := range []Strings{post.To, post.CC} {
+		for _, recipient := range audience {
+			if recipient != activityStreamsPublic && recipient != a.followersIRI && !containsString(recipients, recipient) {
+				recipients = append(recipients, recipient)
+			}
+		}
+	}
+	return recipients
+}
+
+// isFollower tells whether iri follows us
+func (a *Actor) isFollower(iri string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, ok := a.followers[iri]
+	return ok
+}
+
 // Follow a remote user by their iri
 func (a *Actor) Follow(user string) (err error) {
-	remote, err := NewRemoteActor(user)
+	remote, err := a.instance.NewRemoteActor(user)
 	if err != nil {
 		log.Info("Can't contact " + user + " to get their inbox")
 		return
 	}
 
-	follow := make(map[string]interface{})
 	hash, id := a.newItemID()
 
-	follow["@context"] = context()
-	follow["actor"] = a.iri
-	follow["id"] = id
-	follow["object"] = user
-	follow["type"] = "Follow"
+	follow := &Activity{
+		Context: context(),
+		Actor:   NewIRI(a.iri),
+		ID:      id,
+		Object:  NewIRI(user),
+		To:      Strings{user},
+		Type:    "Follow",
+	}
 
+	a.mu.Lock()
+	_, following := a.following[user]
+	_, rejected := a.rejected[user]
+	a.mu.Unlock()
 	// if we are not already following them
-	if _, ok := a.following[user]; !ok {
+	if !following {
 		// if we have not been rejected previously
-		if _, ok := a.rejected[user]; !ok {
-			go func() {
-				err := a.signedHTTPPost(follow, remote.inbox)
-				if err != nil {
-					log.Info("Couldn't follow " + user)
-					log.Info(err)
-					return
-				}
-				// save the activity
-				a.saveItem(hash, follow)
-				a.requested[user] = hash
-				a.save()
-				// we are going to save the request here
-				// and save the follow only on accept so look at
-				// the http handler for the accept code
-			}()
+		if !rejected {
+			// save the activity
+			a.saveItem(hash, follow)
+			a.mu.Lock()
+			a.requested[user] = hash
+			a.mu.Unlock()
+			a.save()
+			// we are going to save the request here
+			// and save the follow only on accept so look at
+			// the http handler for the accept code
+			err = a.deliver(follow, remote.inbox)
+			if err != nil {
+				log.Info("Couldn't follow " + user)
+				log.Info(err)
+				return
+			}
 		}
 	}
 
@@ -646,99 +1017,95 @@ func (a *Actor) Follow(user string) (err error) {
 // was accepted when initially following that user
 // (this is read from the `actor.following` map
 func (a *Actor) Unfollow(user string) {
+	a.mu.Lock()
+	requested, cancelRequest := a.requested[user]
+	following, ok := a.following[user]
+	a.mu.Unlock()
 	// if we have a request to follow this user cancel it
-	cancelRequest := false
-	if _, ok := a.requested[user]; ok {
+	if cancelRequest {
 		log.Info("Cancelling follow request")
-		cancelRequest = true
 		// then continue to send the unfollow to the receipient
 		// to inform them that the request is cancelled.
-	} else if _, ok := a.following[user]; !ok {
+	} else if !ok {
 		log.Info("We are not following this user, ignoring...")
 		return
 	}
 
 	log.Info("Unfollowing " + user)
 
-	var hash string
 	// find the id of the original follow
+	hash, _ := following.(string)
 	if cancelRequest {
-		hash = a.requested[user].(string)
-	} else {
-		hash = a.following[user].(string)
+		hash, _ = requested.(string)
 	}
 
-	// create an undo activiy
-	undo := make(map[string]interface{})
-	undo["@context"] = context()
-	undo["actor"] = a.iri
-	undo["id"] = baseURL + "item/" + hash + "/undo"
-	undo["type"] = "Undo"
-
-	follow := make(map[string]interface{})
-
-	follow["@context"] = context()
-	follow["actor"] = a.iri
-	follow["id"] = baseURL + "item/" + hash
-	follow["object"] = user
-	follow["type"] = "Follow"
+	follow := &Activity{
+		Context: context(),
+		Actor:   NewIRI(a.iri),
+		ID:      a.instance.baseURL + "item/" + hash,
+		Object:  NewIRI(user),
+		Type:    "Follow",
+	}
 
-	// add the properties to the undo activity
-	undo["object"] = follow
+	// create an undo activiy
+	undo := &Activity{
+		Context: context(),
+		Actor:   NewIRI(a.iri),
+		ID:      a.instance.baseURL + "item/" + hash + "/undo",
+		Type:    "Undo",
+		Object:  Embed(follow),
+	}
 
 	// get the remote user's inbox
-	remoteUser, err := NewRemoteActor(user)
+	remoteUser, err := a.instance.NewRemoteActor(user)
 	if err != nil {
 		log.Info("Failed to contact remote actor")
 		return
 	}
 
 	PrettyPrint(undo)
-	go func() {
-		err := a.signedHTTPPost(undo, remoteUser.inbox)
-		if err != nil {
-			log.Info("Couldn't unfollow " + user)
-			log.Info(err)
-			return
-		}
-		// if there was no error then delete the follow
-		// from the list
-		if cancelRequest {
-			delete(a.requested, user)
-		} else {
-			delete(a.following, user)
-		}
-		a.save()
-	}()
+	err = a.deliver(undo, remoteUser.inbox)
+	if err != nil {
+		log.Info("Couldn't unfollow " + user)
+		log.Info(err)
+		return
+	}
+	// if there was no error then delete the follow
+	// from the list
+	a.mu.Lock()
+	if cancelRequest {
+		delete(a.requested, user)
+	} else {
+		delete(a.following, user)
+	}
+	a.mu.Unlock()
+	a.save()
 }
 
 // Announce this activity to our followers
 func (a *Actor) Announce(url string) {
-	// our announcements are public. Public stuff have a "To" to the url below
-	toURL := []string{"https://www.w3.org/ns/activitystreams#Public"}
 	hash, id := a.newItemID()
 
-	announce := make(map[string]interface{})
-
-	announce["@context"] = context()
-	announce["id"] = id
-	announce["type"] = "Announce"
-	announce["object"] = url
-	announce["actor"] = a.iri
-	announce["to"] = toURL
-
-	// cc this to all our followers one by one
-	// I've seen activities to just include the url of the
-	// collection but for now this works.
-
-	// It seems that sharedInbox will be deprecated
-	// so this is probably a better idea anyway (#APConf)
-	announce["cc"] = a.followersSlice()
-
-	// add a timestamp
-	announce["published"] = time.Now().Format(time.RFC3339)
+	announce := &Activity{
+		Context: context(),
+		ID:      id,
+		Type:    "Announce",
+		Object:  NewIRI(url),
+		Actor:   NewIRI(a.iri),
+		// our announcements are public. Public stuff have a "To" to the url below
+		To: Strings{activityStreamsPublic},
+		// cc this to all our followers one by one
+		// I've seen activities to just include the url of the
+		// collection but for now this works.
+
+		// It seems that sharedInbox will be deprecated
+		// so this is probably a better idea anyway (#APConf)
+		CC: a.followersSlice(),
+		// add a timestamp
+		Published: time.Now().Format(time.RFC3339),
+	}
 
-	a.appendToOutbox(announce["id"].(string))
+	a.appendToOutbox(announce.ID)
 	a.saveItem(hash, announce)
 	a.sendToFollowers(announce)
 }
@@ -746,70 +1113,625 @@ func (a *Actor) Announce(url string) {
 func (a *Actor) followersSlice() []string {
 	followersSlice := make([]string, 0)
 	followersSlice = append(followersSlice, a.followersIRI)
+	a.mu.Lock()
 	for k := range a.followers {
 		followersSlice = append(followersSlice, k)
 	}
+	a.mu.Unlock()
 	return followersSlice
 }
 
 // Accept a follow request
-func (a *Actor) Accept(follow map[string]interface{}) {
+func (a *Actor) Accept(follow *Activity) {
 	// it's a follow, write it down
-	newFollower := follow["actor"].(string)
+	newFollower := follow.Actor.ID()
 	// check we aren't following ourselves
-	if newFollower == follow["object"] {
+	if newFollower == follow.Object.ID() {
 		log.Info("You can't follow yourself")
 		return
 	}
 
-	follower, err := NewRemoteActor(follow["actor"].(string))
+	follower, err := a.instance.NewRemoteActor(newFollower)
+	if err != nil || follower.inbox == "" {
+		// they'll have to follow us again, a pending request stays
+		// pending so that it can be approved later
+		log.Info("Couldn't retrieve remote actor info, maybe server is down?")
+		log.Info(err)
+		return
+	}
 
 	// check if this user is already following us
-	if _, ok := a.followers[newFollower]; ok {
+	a.mu.Lock()
+	_, already := a.followers[newFollower]
+	knownSharedInbox := a.sharedInboxes[newFollower]
+	a.mu.Unlock()
+	if already {
 		log.Info("You're already following us, yay!")
-		// do nothing, they're already following us
+		// they're already following us, just make sure we know
+		// their shared inbox
+		if knownSharedInbox != follower.sharedInbox && follower.sharedInbox != "" {
+			a.NewFollower(newFollower, follower.inbox, follower.sharedInbox)
+		}
 	} else {
-		a.NewFollower(newFollower, follower.inbox)
+		a.NewFollower(newFollower, follower.inbox, follower.sharedInbox)
+	}
+
+	a.mu.Lock()
+	// if this was waiting for approval it's not any more
+	_, wasPending := a.pending[newFollower]
+	delete(a.pending, newFollower)
+	// remember the id of the follow so that we can match it
+	// when they undo it
+	newID := follow.ID != "" && a.followIDs[newFollower] != follow.ID
+	if newID {
+		a.followIDs[newFollower] = follow.ID
+	}
+	a.mu.Unlock()
+	if wasPending || newID {
+		a.save()
 	}
 	// send accept anyway even if they are following us already
 	// this is very verbose. I would prefer creating a map by hand
 
 	// remove @context from the inner activity
-	delete(follow, "@context")
+	follow.Context = nil
+
+	_, acceptID := a.newID()
+	accept := &Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		To:      Strings{newFollower},
+		ID:      acceptID,
+		Actor:   NewIRI(a.iri),
+		Object:  Embed(follow),
+		Type:    "Accept",
+	}
+
+	// Maybe we need to save this accept?
+	a.deliver(accept, follower.inbox)
 
-	accept := make(map[string]interface{})
+}
 
-	accept["@context"] = "https://www.w3.org/ns/activitystreams"
-	accept["to"] = follow["actor"]
-	_, accept["id"] = a.newID()
-	accept["actor"] = a.iri
-	accept["object"] = follow
-	accept["type"] = "Accept"
+// SetManuallyApprovesFollowers turns manual approval of follow requests
+// on or off. When it's on, incoming follows are kept in a list of pending
+// followers (see PendingFollowers) until ApproveFollower or RejectFollower
+// is called for them, and OnFollowRequest is called instead of OnFollow.
+func (a *Actor) SetManuallyApprovesFollowers(manual bool) error {
+	a.mu.Lock()
+	a.manuallyApprovesFollowers = manual
+	a.mu.Unlock()
+	return a.save()
+}
 
+// ManuallyApprovesFollowers tells whether follow requests need approval
+func (a *Actor) ManuallyApprovesFollowers() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.manuallyApprovesFollowers
+}
+
+// addPendingFollower stores a follow request until it's approved or
+// rejected
+func (a *Actor) addPendingFollower(follow *Activity) error {
+	follower := follow.Actor.ID()
+	if follower == "" {
+		return errors.New("follow request without an actor")
+	}
+	a.mu.Lock()
+	a.pending[follower] = follow
+	a.mu.Unlock()
+	return a.save()
+}
+
+// PendingFollowers returns the actors waiting for approval to follow us
+// along with the ids of their follow requests
+func (a *Actor) PendingFollowers() map[string]string {
+	a.mu.Lock()
+	followers := make([]string, 0, len(a.pending))
+	for follower := range a.pending {
+		followers = append(followers, follower)
+	}
+	a.mu.Unlock()
+	p := make(map[string]string)
+	for _, follower := range followers {
+		follow, err := a.pendingFollow(follower)
+		if err == nil {
+			p[follower] = follow.ID
+		}
+	}
+	return p
+}
+
+// pendingFollow returns the pending follow request of the actor iri
+func (a *Actor) pendingFollow(iri string) (*Activity, error) {
+	a.mu.Lock()
+	pending := a.pending[iri]
+	a.mu.Unlock()
+	switch follow := pending.(type) {
+	case *Activity:
+		return follow, nil
+	case map[string]interface{}:
+		// this is what we get back from storage
+		return objectFromMap(follow)
+	}
+	return nil, errors.New("no pending follow request from " + iri)
+}
+
+// ApproveFollower accepts the pending follow request of the actor iri
+func (a *Actor) ApproveFollower(iri string) error {
+	follow, err := a.pendingFollow(iri)
+	if err != nil {
+		return err
+	}
+	// Accept takes care of removing it from the pending list, unless
+	// it can't reach them
+	a.Accept(follow)
+	if _, err := a.pendingFollow(iri); err == nil {
+		return errors.New("couldn't reach " + iri + " to accept their follow request")
+	}
+	return nil
+}
+
+// RejectFollower rejects the pending follow request of the actor iri
+func (a *Actor) RejectFollower(iri string) error {
+	follow, err := a.pendingFollow(iri)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	delete(a.pending, iri)
+	a.mu.Unlock()
+	err = a.save()
+	if err != nil {
+		return err
+	}
+	return a.reject(follow)
+}
+
+// reject sends a Reject for a follow request
+func (a *Actor) reject(follow *Activity) error {
+	iri := follow.Actor.ID()
+	follower, err := a.instance.NewRemoteActor(iri)
 	if err != nil {
 		log.Info("Couldn't retrieve remote actor info, maybe server is down?")
+		return err
+	}
+
+	// remove @context from the inner activity
+	follow.Context = nil
+
+	_, rejectID := a.newID()
+	reject := &Activity{
+		Context: "https://www.w3.org/ns/activitystreams",
+		To:      Strings{iri},
+		ID:      rejectID,
+		Actor:   NewIRI(a.iri),
+		Object:  Embed(follow),
+		Type:    "Reject",
+	}
+
+	return a.deliver(reject, follower.inbox)
+}
+
+// SetAliases sets the iris of the other accounts of the actor, which
+// other servers check before accepting a move from one of them to us
+func (a *Actor) SetAliases(aliases []string) error {
+	a.mu.Lock()
+	a.alsoKnownAs = aliases
+	a.mu.Unlock()
+	return a.save()
+}
+
+// Aliases returns the iris of the other accounts of the actor
+func (a *Actor) Aliases() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.alsoKnownAs
+}
+
+// MovedTo returns the iri of the account the actor moved to, if any
+func (a *Actor) MovedTo() string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.movedTo
+}
+
+// MoveTo moves the actor to the account at target, which has to list
+// us in its alsoKnownAs. Our followers are told to follow the new
+// account instead and we don't accept new followers any more
+func (a *Actor) MoveTo(target string) error {
+	if target == a.iri {
+		return errors.New("can't move to ourselves")
+	}
+	// the alias was probably added just now so don't use a cached copy
+	info, err := a.instance.getCached(target, true)
+	if err != nil {
+		log.Info("Couldn't fetch " + target)
+		return err
+	}
+	if !stringsOf(info["alsoKnownAs"]).Contains(a.iri) {
+		return errors.New(target + " doesn't list " + a.iri + " in alsoKnownAs")
+	}
+
+	a.mu.Lock()
+	a.movedTo = target
+	a.mu.Unlock()
+	err = a.save()
+	if err != nil {
+		return err
+	}
+
+	_, id := a.newID()
+	move := &Activity{
+		Context: context(),
+		ID:      id,
+		Type:    "Move",
+		Actor:   NewIRI(a.iri),
+		Object:  NewIRI(a.iri),
+		Target:  NewIRI(target),
+		To:      Strings{a.followersIRI},
+	}
+	return a.sendToFollowers(move)
+}
+
+// removeFollower deletes a follower and everything we know about them
+func (a *Actor) removeFollower(iri string) error {
+	a.mu.Lock()
+	delete(a.followers, iri)
+	delete(a.sharedInboxes, iri)
+	delete(a.followIDs, iri)
+	a.mu.Unlock()
+	return a.save()
+}
+
+// handleUndo processes an Undo sent to our inbox. For now the only
+// thing we know how to undo is a Follow, which means that a remote
+// actor unfollowed us or withdrew their follow request
+func (a *Actor) handleUndo(undo *Activity) {
+	follower := undo.Actor.ID()
+	a.mu.Lock()
+	storedID, _ := a.followIDs[follower].(string)
+	_, following := a.followers[follower]
+	a.mu.Unlock()
+	var followID string
+	switch {
+	case undo.Object == nil:
+		log.Info("Undo without an object, ignoring")
+		return
+	case undo.Object.Object == nil:
+		// all we have is the id of the activity so we can only
+		// go on if it's the id of the follow we know of
+		followID = undo.Object.IRI
+		if a.withdrawFollowRequest(follower, followID) {
+			return
+		}
+		if storedID == "" || storedID != followID {
+			log.Info("Can't match the Undo with a Follow from " + follower + ", ignoring")
+			return
+		}
+	default:
+		follow := undo.Object.Object
+		if follow.Type != "Follow" {
+			log.Info("Don't know how to undo this kind of activity, ignoring")
+			return
+		}
+		if follow.Actor.ID() != follower {
+			log.Info("Can't undo a follow of somebody else, ignoring")
+			return
+		}
+		if follow.Object.ID() != a.iri {
+			log.Info("This is not for us, ignoring")
+			return
+		}
+		followID = follow.ID
+		if a.withdrawFollowRequest(follower, followID) {
+			return
+		}
+	}
+
+	if !following {
+		log.Info(follower + " is not following us, ignoring the Undo")
+		return
+	}
+	// older followers don't have the follow id stored so we can only
+	// check it when we have it
+	if storedID != "" && followID != "" && storedID != followID {
+		log.Info("Follow id mismatch in Undo from " + follower + ", ignoring")
+		return
+	}
+
+	log.Info(follower + " unfollowed us")
+	err := a.removeFollower(follower)
+	if err != nil {
+		log.Info("Couldn't save the actor after removing a follower")
 		log.Info(err)
 	}
+	a.OnUnfollow(undo)
+}
 
-	// Maybe we need to save this accept?
-	go a.signedHTTPPost(accept, follower.inbox)
+// withdrawFollowRequest drops the pending follow request of follower
+// if it's the one with followID, as they don't want to follow us any
+// more. It tells whether there was one
+func (a *Actor) withdrawFollowRequest(follower, followID string) bool {
+	follow, err := a.pendingFollow(follower)
+	if err != nil {
+		return false
+	}
+	// like with followers we may not know the id of older requests
+	if follow.ID != "" && followID != "" && follow.ID != followID {
+		log.Info("Follow id mismatch in Undo from " + follower + ", ignoring")
+		return false
+	}
+	log.Info(follower + " withdrew their follow request")
+	a.mu.Lock()
+	delete(a.pending, follower)
+	a.mu.Unlock()
+	err = a.save()
+	if err != nil {
+		log.Info("Couldn't save the actor after removing a follow request")
+		log.Info(err)
+	}
+	return true
+}
+
+// forget removes every trace of a remote actor from our lists,
+// e.g. because they deleted their account
+func (a *Actor) forget(iri string) error {
+	changed := false
+	a.mu.Lock()
+	for _, list := range []map[string]interface{}{a.followers, a.following, a.requested,
+		a.sharedInboxes, a.followIDs, a.pending} {
+		if _, ok := list[iri]; ok {
+			delete(list, iri)
+			changed = true
+		}
+	}
+	a.mu.Unlock()
+	if !changed {
+		return nil
+	}
+	return a.save()
+}
+
+// handleDelete processes a Delete sent to our inbox. If a remote actor
+// deleted their account every local actor forgets about them, otherwise
+// we drop any copy of the deleted object we have cached.
+// getActor returns the local actor with that name
+func (a *Actor) handleDelete(del *Activity, getActor func(name string) (Actor, error)) {
+	deleter := del.Actor.ID()
+	object := del.Object.ID()
+	if object == "" {
+		log.Info("Delete without an object, ignoring")
+		return
+	}
+
+	if object == deleter {
+		log.Info(deleter + " deleted their account")
+		names, err := a.instance.store.ActorNames()
+		if err != nil {
+			log.Info("Can't list the local actors")
+			log.Info(err)
+		}
+		for _, name := range names {
+			actor, err := getActor(name)
+			if err != nil {
+				continue
+			}
+			err = actor.forget(deleter)
+			if err != nil {
+				log.Info("Couldn't remove " + deleter + " from " + name)
+				log.Info(err)
+			}
+		}
+	} else if !a.instance.mayModifyCached(object, deleter) {
+		log.Info(deleter + " can't delete " + object + ", ignoring")
+		return
+	}
+
+	err := a.instance.store.DeleteForeign(object)
+	if err != nil {
+		log.Info("Couldn't remove " + object + " from the cache")
+		log.Info(err)
+	}
+	a.OnDelete(del)
+}
+
+// handleUpdate processes an Update sent to our inbox. If a remote actor
+// updated their profile we refresh their inbox, shared inbox and key in
+// all our local actors, otherwise we refresh our cached copy of the
+// updated object (e.g. an edited note).
+// getActor returns the local actor with that name
+func (a *Actor) handleUpdate(update *Activity, getActor func(name string) (Actor, error)) {
+	updater := update.Actor.ID()
+	if update.Object == nil || update.Object.Object == nil {
+		// we could fetch it but a remote server that doesn't embed the
+		// object is probably not sending us anything we care about
+		log.Info("Update without an embedded object, ignoring")
+		return
+	}
+	object := update.Object.Object
+
+	if object.ID == updater {
+		a.instance.refreshRemoteActor(object, getActor)
+	} else {
+		if author := authorOf(object); author != "" && author != updater {
+			log.Info(updater + " can't update an object of " + author + ", ignoring")
+			return
+		}
+		if !a.instance.mayModifyCached(object.ID, updater) {
+			log.Info(updater + " can't update " + object.ID + ", ignoring")
+			return
+		}
+		// only refresh what we have cached, we don't want to
+		// store everything that comes our way
+		if _, err := a.instance.store.LoadForeign(object.ID); err == nil {
+			err = a.instance.store.SaveForeign(object.ID, object.Raw)
+			if err != nil {
+				log.Info("Couldn't update " + object.ID + " in the cache")
+				log.Info(err)
+			}
+		}
+	}
+	a.OnUpdate(update)
+}
+
+// refreshRemoteActor updates what we know about a remote actor from
+// the new version of their document
+func (i *Instance) refreshRemoteActor(object *Object, getActor func(name string) (Actor, error)) {
+	remote := i.remoteActorFromInfo(object.ID, object.Raw)
+	if remote.inbox == "" {
+		log.Info("Updated actor " + object.ID + " has no inbox, ignoring")
+		return
+	}
+
+	// refresh the cached document, under the ids of its keys too as
+	// that's where fetchPublicKey looks for them. Only the keys that live
+	// in the document itself, anything else could be somebody else's
+	var keys []interface{}
+	switch k := object.Raw["publicKey"].(type) {
+	case map[string]interface{}:
+		keys = append(keys, k)
+	case []interface{}:
+		keys = k
+	}
+	iris := []string{object.ID}
+	for _, key := range keys {
+		iri := iriOf(key)
+		if iri == "" || iri == object.ID || withoutFragment(iri) != object.ID {
+			continue
+		}
+		iris = append(iris, iri)
+	}
+	for _, iri := range iris {
+		err := i.store.SaveForeign(iri, object.Raw)
+		if err != nil {
+			log.Info("Couldn't cache " + iri)
+			log.Info(err)
+		}
+	}
+
+	names, err := i.store.ActorNames()
+	if err != nil {
+		log.Info("Can't list the local actors")
+		log.Info(err)
+	}
+	for _, name := range names {
+		actor, err := getActor(name)
+		if err != nil {
+			continue
+		}
+		actor.mu.Lock()
+		known, follows := actor.followers[object.ID]
+		sharedInbox, _ := actor.sharedInboxes[object.ID].(string)
+		actor.mu.Unlock()
+		if !follows {
+			continue
+		}
+		inbox, _ := known.(string)
+		if inbox == remote.inbox && sharedInbox == remote.sharedInbox {
+			continue
+		}
+		err = actor.NewFollower(object.ID, remote.inbox, remote.sharedInbox)
+		if err != nil {
+			log.Info("Couldn't update the inbox of " + object.ID + " in " + name)
+			log.Info(err)
+		}
+	}
+}
 
+// handleMove processes a Move sent to our inbox by a remote actor we
+// follow that migrated to a new account. If the new account confirms
+// the move by listing the old one in its alsoKnownAs we follow it
+// instead of the old one, unless the instance is configured otherwise
+func (a *Actor) handleMove(move *Activity) {
+	from := move.Actor.ID()
+	to := move.Target.ID()
+	if move.Object.ID() != from {
+		log.Info(from + " can't move somebody else, ignoring")
+		return
+	}
+	if to == "" || to == from {
+		log.Info("Move from " + from + " without a target, ignoring")
+		return
+	}
+	a.mu.Lock()
+	_, following := a.following[from]
+	_, requested := a.requested[from]
+	a.mu.Unlock()
+	if !following && !requested {
+		log.Info("We don't follow " + from + ", ignoring the Move")
+		return
+	}
+
+	// the target has to confirm that it's the same person, always
+	// fetch it fresh as the alias was probably added just now
+	target, err := a.instance.getCached(to, true)
+	if err != nil {
+		log.Info("Couldn't fetch the target of the Move " + to)
+		return
+	}
+	if !stringsOf(target["alsoKnownAs"]).Contains(from) {
+		log.Info(to + " doesn't list " + from + " in alsoKnownAs, ignoring the Move")
+		return
+	}
+
+	if a.instance.followMoves {
+		log.Info(from + " moved to " + to + ", following them there")
+		a.Unfollow(from)
+		err = a.Follow(to)
+		if err != nil {
+			log.Info("Couldn't follow " + to)
+			log.Info(err)
+		}
+	}
+	a.OnMove(move)
+}
+
+// mayModifyCached tells whether actor is allowed to update or delete
+// the object at iri, which is only the case for its author. If we
+// don't have the object cached there's nothing to protect
+func (i *Instance) mayModifyCached(iri, actor string) bool {
+	cached, err := i.store.LoadForeign(iri)
+	if err != nil {
+		return true
+	}
+	cachedObject, err := objectFromMap(cached)
+	if err != nil {
+		return true
+	}
+	author := authorOf(cachedObject)
+	return author == "" || author == actor
+}
+
+// authorOf returns the iri of the actor that created an object
+func authorOf(object *Object) string {
+	if len(object.AttributedTo) > 0 {
+		return object.AttributedTo[0]
+	}
+	// actors are their own
+	if _, ok := object.Raw["inbox"]; ok {
+		return object.ID
+	}
+	return object.Actor.ID()
 }
 
 // Followers returns the list of followers
 func (a *Actor) Followers() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	f := make(map[string]string)
 	for follower, inbox := range a.followers {
-		f[follower] = inbox.(string)
+		f[follower], _ = inbox.(string)
 	}
 	return f
 }
 
 // Following returns the list of followers
 func (a *Actor) Following() map[string]string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
 	f := make(map[string]string)
 	for followee, hash := range a.following {
-		f[followee] = hash.(string)
+		f[followee], _ = hash.(string)
 	}
 	return f
 }
@@ -0,0 +1,663 @@
+package activityserve
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestActorCopiesShareState(t *testing.T) {
+	base := remoteServer(t, map[string]func(string) interface{}{
+		"/users/alice": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":          base + "/users/alice",
+				"type":        "Person",
+				"alsoKnownAs": []string{"https://local.example/alice"},
+			}
+		},
+	})
+	tests := []struct {
+		name string
+		// change changes the actor through the copy of the application
+		change func(app Actor) error
+		// seen tells whether the change shows in another copy and in
+		// what was saved
+		seen func(served Actor, saved *ActorToSave) bool
+	}{
+		{
+			"aliases",
+			func(app Actor) error { return app.SetAliases([]string{base + "/users/alice"}) },
+			func(served Actor, saved *ActorToSave) bool {
+				return len(served.Aliases()) == 1 && len(saved.AlsoKnownAs) == 1
+			},
+		},
+		{
+			"move",
+			func(app Actor) error { return app.MoveTo(base + "/users/alice") },
+			func(served Actor, saved *ActorToSave) bool {
+				return served.MovedTo() == base+"/users/alice" && saved.MovedTo == base+"/users/alice"
+			},
+		},
+		{
+			"manual approval",
+			func(app Actor) error { return app.SetManuallyApprovesFollowers(true) },
+			func(served Actor, saved *ActorToSave) bool {
+				return served.ManuallyApprovesFollowers() && saved.ManuallyApprovesFollowers
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the move is sent to the followers
+			i := newDeliveringInstance(t)
+			app, err := i.MakeActor("alice", "", "Person")
+			if err != nil {
+				t.Fatal(err)
+			}
+			served, err := i.LoadActor("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// followers come in on the served copy while the
+			// application changes the actor through its own
+			var wg sync.WaitGroup
+			for n := 0; n < 20; n++ {
+				wg.Add(1)
+				go func(n int) {
+					defer wg.Done()
+					iri := fmt.Sprintf("https://remote.example/users/%d", n)
+					served.NewFollower(iri, iri+"/inbox", "")
+				}(n)
+			}
+			err = test.change(app)
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Wait()
+			// saving the copy that was loaded before the change keeps it
+			err = served.save()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			saved, err := i.store.LoadActor("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !test.seen(served, saved) {
+				t.Error("the change was lost")
+			}
+			if got := len(app.Followers()); got != 20 {
+				t.Errorf("the application sees %d followers, want 20", got)
+			}
+			if got := len(saved.Followers); got != 20 {
+				t.Errorf("%d followers were saved, want 20", got)
+			}
+		})
+	}
+}
+
+// inboxServer serves an actor with an inbox at any path and sends the
+// path of the inbox and the type of each activity posted to it on the
+// channel it returns along with its url
+func inboxServer(t *testing.T) (string, chan [2]string) {
+	t.Helper()
+	received := make(chan [2]string, 10)
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			var activity map[string]interface{}
+			json.NewDecoder(r.Body).Decode(&activity)
+			typ, _ := activity["type"].(string)
+			received <- [2]string{r.URL.Path, typ}
+			return
+		}
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"id":    srv.URL + r.URL.Path,
+			"type":  "Person",
+			"inbox": srv.URL + r.URL.Path + "/inbox",
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL, received
+}
+
+// newDeliveringInstance returns an instance for tests that deliver
+// activities. The workers may still be cleaning up the queue after the
+// test so t.TempDir can't remove its storage
+func newDeliveringInstance(t *testing.T) *Instance {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "activityserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return NewInstance("https://local.example/", NewFileStore(dir))
+}
+
+func TestDirectPostsStayDirect(t *testing.T) {
+	base, received := inboxServer(t)
+	i := newDeliveringInstance(t)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actor.NewFollower(base+"/users/carol", base+"/users/carol/inbox", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := actor.CreateNoteWithOptions("hi bob", NoteOptions{
+		Visibility: VisibilityDirect,
+		Recipients: []string{base + "/users/bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actor.UpdateNote(id, "hello bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actor.DeletePost(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(map[string]bool)
+	timeout := time.After(5 * time.Second)
+	for len(got) < 3 {
+		select {
+		case delivery := <-received:
+			if delivery[0] != "/users/bob/inbox" {
+				t.Fatalf("a direct %s was sent to %s", delivery[1], delivery[0])
+			}
+			got[delivery[1]] = true
+		case <-timeout:
+			t.Fatalf("bob only got %v", got)
+		}
+	}
+	for _, typ := range []string{"Create", "Update", "Delete"} {
+		if !got[typ] {
+			t.Errorf("bob didn't get the %s", typ)
+		}
+	}
+	select {
+	case delivery := <-received:
+		t.Fatalf("a direct %s was sent to %s", delivery[1], delivery[0])
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// activityFrom turns an activity written as a map into an Activity as
+// if it came in to our inbox
+func activityFrom(t *testing.T, m map[string]interface{}) *Activity {
+	t.Helper()
+	activity, err := objectFromMap(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return activity
+}
+
+func TestUpdateCantCacheOverOtherObjects(t *testing.T) {
+	i := newTestInstance(t)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := map[string]interface{}{
+		"id":           "https://victim.example/notes/1",
+		"type":         "Note",
+		"attributedTo": "https://victim.example/u",
+	}
+	err = i.store.SaveForeign("https://victim.example/notes/1", note)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	actor.handleUpdate(activityFrom(t, map[string]interface{}{
+		"type":  "Update",
+		"actor": "https://evil.example/u",
+		"object": map[string]interface{}{
+			"id":    "https://evil.example/u",
+			"type":  "Person",
+			"inbox": "https://evil.example/u/inbox",
+			"publicKey": []interface{}{
+				map[string]interface{}{"id": "https://evil.example/u#main-key"},
+				map[string]interface{}{"id": "https://victim.example/notes/1"},
+				map[string]interface{}{"id": "https://evil.example/keys/u"},
+			},
+		},
+	}), i.LoadActor)
+
+	cached, err := i.store.LoadForeign("https://victim.example/notes/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cached["type"] != "Note" {
+		t.Fatalf("the note was replaced with %v", cached)
+	}
+	if i.mayModifyCached("https://victim.example/notes/1", "https://evil.example/u") {
+		t.Fatal("somebody else may modify the note")
+	}
+	for iri, cachedToo := range map[string]bool{
+		"https://evil.example/u":          true,
+		"https://evil.example/u#main-key": true,
+		"https://evil.example/keys/u":     false,
+	} {
+		_, err := i.store.LoadForeign(iri)
+		if (err == nil) != cachedToo {
+			t.Errorf("%s: cached is %v, want %v", iri, err == nil, cachedToo)
+		}
+	}
+}
+
+func TestUndoWithdrawsFollowRequest(t *testing.T) {
+	follow := map[string]interface{}{
+		"id":     "https://remote.example/follows/1",
+		"type":   "Follow",
+		"actor":  "https://remote.example/users/bob",
+		"object": "https://local.example/alice",
+	}
+	tests := []struct {
+		name      string
+		object    interface{}
+		withdrawn bool
+	}{
+		{"embedded follow", follow, true},
+		{"follow id", "https://remote.example/follows/1", true},
+		{"other follow", "https://remote.example/follows/2", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestInstance(t)
+			actor, err := i.MakeActor("alice", "", "Person")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = actor.addPendingFollower(activityFrom(t, follow))
+			if err != nil {
+				t.Fatal(err)
+			}
+			actor.handleUndo(activityFrom(t, map[string]interface{}{
+				"type":   "Undo",
+				"actor":  "https://remote.example/users/bob",
+				"object": test.object,
+			}))
+			_, pending := actor.PendingFollowers()["https://remote.example/users/bob"]
+			if pending == test.withdrawn {
+				t.Fatalf("pending is %v after the Undo", pending)
+			}
+			// and it stays that way
+			loaded, err := i.store.LoadActor("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, saved := loaded.Pending["https://remote.example/users/bob"]; saved == test.withdrawn {
+				t.Fatalf("saved pending is %v after the Undo", saved)
+			}
+		})
+	}
+}
+
+func TestUpdateNoteParsesContent(t *testing.T) {
+	base, received := inboxServer(t)
+	i := newDeliveringInstance(t)
+	i.SetTagsURL("https://local.example/tags/")
+	err := i.store.SaveForeign("acct:carol@remote.example", map[string]interface{}{
+		"links": []interface{}{map[string]interface{}{
+			"rel":  "self",
+			"type": "application/activity+json",
+			"href": base + "/users/carol",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, err := actor.CreateNoteWithOptions("hi bob", NoteOptions{
+		Visibility: VisibilityDirect,
+		Recipients: []string{base + "/users/bob"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actor.UpdateNote(id, "hi bob and @carol@remote.example #cats")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, create, err := actor.loadPost(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	note := create.Object.Object
+	if !strings.Contains(note.Content, `class="u-url mention"`) || !strings.Contains(note.Content, `class="mention hashtag"`) {
+		t.Errorf("the edit wasn't linked: %s", note.Content)
+	}
+	if len(note.Tag) != 2 {
+		t.Errorf("got tags %+v", note.Tag)
+	}
+	if !note.To.Contains(base+"/users/bob") || !note.To.Contains(base+"/users/carol") || len(note.CC) > 0 {
+		t.Errorf("the direct note was addressed to %v and %v", note.To, note.CC)
+	}
+
+	// carol gets the edit she's mentioned in
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case delivery := <-received:
+			if delivery == [2]string{"/users/carol/inbox", "Update"} {
+				return
+			}
+		case <-timeout:
+			t.Fatal("carol didn't get the Update")
+		}
+	}
+}
+
+func TestHandleDelete(t *testing.T) {
+	const (
+		carol = "https://remote.example/users/carol"
+		evil  = "https://evil.example/users/eve"
+		note  = "https://remote.example/notes/1"
+	)
+	tests := []struct {
+		name    string
+		deleter string
+		cached  map[string]interface{}
+		// whether the note is gone from the cache and OnDelete called
+		deleted bool
+	}{
+		{"own note", carol, map[string]interface{}{"id": note, "type": "Note", "attributedTo": carol}, true},
+		{"note of somebody else", evil, map[string]interface{}{"id": note, "type": "Note", "attributedTo": carol}, false},
+		{"note we don't have", evil, nil, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestInstance(t)
+			actor, err := i.MakeActor("alice", "", "Person")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.cached != nil {
+				err = i.store.SaveForeign(note, test.cached)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			called := false
+			actor.OnDelete = func(*Activity) { called = true }
+
+			actor.handleDelete(activityFrom(t, map[string]interface{}{
+				"type":   "Delete",
+				"actor":  test.deleter,
+				"object": map[string]interface{}{"id": note, "type": "Tombstone"},
+			}), i.LoadActor)
+
+			_, err = i.store.LoadForeign(note)
+			if gone := err != nil; gone != test.deleted {
+				t.Errorf("the note is gone: %v", gone)
+			}
+			if called != test.deleted {
+				t.Errorf("OnDelete was called: %v", called)
+			}
+		})
+	}
+}
+
+func TestHandleDeleteAccount(t *testing.T) {
+	const carol = "https://remote.example/users/carol"
+	i := newTestInstance(t)
+	var actors []Actor
+	for _, name := range []string{"alice", "bob"} {
+		actor, err := i.MakeActor(name, "", "Person")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = actor.NewFollower(carol, carol+"/inbox", "https://remote.example/inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+		actor.mu.Lock()
+		actor.following[carol] = "hash"
+		actor.mu.Unlock()
+		actors = append(actors, actor)
+	}
+	err := i.store.SaveForeign(carol, map[string]interface{}{"id": carol, "type": "Person", "inbox": carol + "/inbox"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// somebody else can't delete carol
+	actors[0].handleDelete(activityFrom(t, map[string]interface{}{
+		"type":   "Delete",
+		"actor":  "https://evil.example/users/eve",
+		"object": carol,
+	}), i.LoadActor)
+	if len(actors[1].Followers()) != 1 {
+		t.Fatal("carol was deleted by somebody else")
+	}
+	if _, err := i.store.LoadForeign(carol); err != nil {
+		t.Fatal("carol was deleted from the cache by somebody else")
+	}
+
+	actors[0].handleDelete(activityFrom(t, map[string]interface{}{
+		"type":   "Delete",
+		"actor":  carol,
+		"object": carol,
+	}), i.LoadActor)
+	for _, actor := range actors {
+		if len(actor.Followers()) != 0 || len(actor.Following()) != 0 {
+			t.Errorf("%s still knows carol: %v %v", actor.Name, actor.Followers(), actor.Following())
+		}
+		saved, err := i.store.LoadActor(actor.Name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(saved.Followers) != 0 || len(saved.SharedInboxes) != 0 {
+			t.Errorf("%s still has carol saved", actor.Name)
+		}
+	}
+	if _, err := i.store.LoadForeign(carol); err == nil {
+		t.Error("carol is still cached")
+	}
+}
+
+func TestHandleUpdate(t *testing.T) {
+	const (
+		carol = "https://remote.example/users/carol"
+		evil  = "https://evil.example/users/eve"
+		note  = "https://remote.example/notes/1"
+	)
+	original := map[string]interface{}{"id": note, "type": "Note", "attributedTo": carol, "content": "hi"}
+	tests := []struct {
+		name    string
+		updater string
+		author  string
+		cached  map[string]interface{}
+		// the content we have cached afterwards, if any
+		want    string
+		updated bool
+	}{
+		{"edited note", carol, carol, original, "edited", true},
+		{"note of somebody else", evil, carol, original, "hi", false},
+		{"note claiming to be of the updater", evil, evil, original, "hi", false},
+		{"note we don't have", carol, carol, nil, "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestInstance(t)
+			actor, err := i.MakeActor("alice", "", "Person")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.cached != nil {
+				err = i.store.SaveForeign(note, test.cached)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			called := false
+			actor.OnUpdate = func(*Activity) { called = true }
+
+			actor.handleUpdate(activityFrom(t, map[string]interface{}{
+				"type":  "Update",
+				"actor": test.updater,
+				"object": map[string]interface{}{
+					"id":           note,
+					"type":         "Note",
+					"attributedTo": test.author,
+					"content":      "edited",
+				},
+			}), i.LoadActor)
+
+			cached, _ := i.store.LoadForeign(note)
+			if got, _ := cached["content"].(string); got != test.want {
+				t.Errorf("got %q cached, want %q", got, test.want)
+			}
+			if called != test.updated {
+				t.Errorf("OnUpdate was called: %v", called)
+			}
+		})
+	}
+}
+
+func TestHandleUpdateProfile(t *testing.T) {
+	const carol = "https://remote.example/users/carol"
+	i := newTestInstance(t)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = actor.NewFollower(carol, carol+"/inbox", "https://remote.example/inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	profile := map[string]interface{}{
+		"id":        carol,
+		"type":      "Person",
+		"name":      "Carol",
+		"inbox":     "https://new.example/users/carol/inbox",
+		"endpoints": map[string]interface{}{"sharedInbox": "https://new.example/inbox"},
+		"publicKey": map[string]interface{}{"id": carol + "#main-key", "owner": carol, "publicKeyPem": "key"},
+	}
+	// only carol can update carol
+	actor.handleUpdate(activityFrom(t, map[string]interface{}{
+		"type":   "Update",
+		"actor":  "https://evil.example/users/eve",
+		"object": profile,
+	}), i.LoadActor)
+	if got := actor.Followers()[carol]; got != carol+"/inbox" {
+		t.Fatalf("somebody else moved the inbox of carol to %s", got)
+	}
+
+	actor.handleUpdate(activityFrom(t, map[string]interface{}{
+		"type":   "Update",
+		"actor":  carol,
+		"object": profile,
+	}), i.LoadActor)
+	if got := actor.Followers()[carol]; got != "https://new.example/users/carol/inbox" {
+		t.Errorf("the inbox of carol is %s", got)
+	}
+	saved, err := i.store.LoadActor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := saved.SharedInboxes[carol]; got != "https://new.example/inbox" {
+		t.Errorf("the shared inbox of carol is %v", got)
+	}
+	for _, iri := range []string{carol, carol + "#main-key"} {
+		cached, err := i.store.LoadForeign(iri)
+		if err != nil || cached["name"] != "Carol" {
+			t.Errorf("%s: got %v cached", iri, cached)
+		}
+	}
+}
+
+func TestHandleMove(t *testing.T) {
+	base := remoteServer(t, map[string]func(string) interface{}{
+		"/users/old": func(base string) interface{} {
+			return map[string]interface{}{"id": base + "/users/old", "type": "Person", "inbox": base + "/users/old/inbox"}
+		},
+		// the new account confirms the move
+		"/users/new": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":          base + "/users/new",
+				"type":        "Person",
+				"inbox":       base + "/users/new/inbox",
+				"alsoKnownAs": []string{base + "/users/old"},
+			}
+		},
+		// somebody that has nothing to do with the old account
+		"/users/stranger": func(base string) interface{} {
+			return map[string]interface{}{"id": base + "/users/stranger", "type": "Person", "inbox": base + "/users/stranger/inbox"}
+		},
+	})
+	old, moved, stranger := base+"/users/old", base+"/users/new", base+"/users/stranger"
+
+	tests := []struct {
+		name        string
+		object      string
+		target      string
+		following   bool
+		followMoves bool
+		// whether we follow the new account instead and OnMove is called
+		followed bool
+		called   bool
+	}{
+		{"confirmed move", old, moved, true, true, true, true},
+		{"move to an account that doesn't confirm it", old, stranger, true, true, false, false},
+		{"move of somebody else", stranger, moved, true, true, false, false},
+		{"move of somebody we don't follow", old, moved, false, true, false, false},
+		{"move left to the application", old, moved, true, false, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newDeliveringInstance(t)
+			i.SetFollowMoves(test.followMoves)
+			actor, err := i.MakeActor("alice", "", "Person")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if test.following {
+				actor.mu.Lock()
+				actor.following[old] = "hash"
+				actor.mu.Unlock()
+			}
+			called := false
+			actor.OnMove = func(*Activity) { called = true }
+
+			actor.handleMove(activityFrom(t, map[string]interface{}{
+				"type":   "Move",
+				"actor":  old,
+				"object": test.object,
+				"target": test.target,
+			}))
+
+			actor.mu.Lock()
+			_, requested := actor.requested[moved]
+			_, following := actor.following[old]
+			actor.mu.Unlock()
+			if requested != test.followed || following != (test.following && !test.followed) {
+				t.Errorf("requested the new account: %v, still following the old one: %v", requested, following)
+			}
+			if called != test.called {
+				t.Errorf("OnMove was called: %v", called)
+			}
+		})
+	}
+}
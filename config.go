@@ -0,0 +1,316 @@
+package activityserve
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+)
+
+// Config holds everything needed to set an Instance up. It can be built
+// in code (start from DefaultConfig), loaded from an INI or TOML file
+// with LoadConfig and overridden by environment variables with LoadEnv.
+//
+// Both file formats use the same keys, e.g. in TOML:
+//
+//	[general]
+//	baseURL = "https://example.com/"
+//	storage = "storage"
+//	storageType = "filesystem" # or sqlite
+//	userAgent = "activityserve"
+//	listen = ":8081"
+//	requestTimeout = "30s"
+//	maxClockSkew = "12h"
+//	followMoves = true
+//	tagsURL = "https://example.com/tags/"
+//	debug = false
+//
+//	[delivery]
+//	retryDelay = "30s"
+//	maxRetryDelay = "6h"
+//	maxAge = "48h"
+//	workers = 8
+//	perHost = 2
+type Config struct {
+	BaseURL     string `toml:"baseURL"`
+	Storage     string `toml:"storage"`
+	StorageType string `toml:"storageType"`
+	UserAgent   string `toml:"userAgent"`
+	// ListenAddress is the address Serve listens on
+	ListenAddress string `toml:"listen"`
+	// RequestTimeout is the timeout of our requests to other servers
+	RequestTimeout time.Duration `toml:"requestTimeout"`
+	// MaxClockSkew is how far the Date header of an incoming request can
+	// be from our own clock before we reject it
+	MaxClockSkew time.Duration `toml:"maxClockSkew"`
+	// FollowMoves makes local actors follow the new account of the remote
+	// actors they follow when these move, after unfollowing the old one.
+	// If it's off it's up to the application to handle OnMove
+	FollowMoves bool `toml:"followMoves"`
+	// TagsURL is the page hashtags link to, with the tag appended (e.g.
+	// https://example.com/tags/). We don't serve one so it's up to the
+	// application, without it hashtags are tagged but not linked
+	TagsURL string `toml:"tagsURL"`
+	// Debug enables the info level logs and the debug output
+	Debug bool `toml:"debug"`
+
+	Delivery DeliveryConfig `toml:"-"`
+}
+
+// DeliveryConfig holds the settings of the delivery queue
+type DeliveryConfig struct {
+	// RetryDelay is the delay before the first retry, doubled
+	// on each subsequent one
+	RetryDelay time.Duration `toml:"retryDelay"`
+	// MaxRetryDelay is the longest we wait between two attempts
+	MaxRetryDelay time.Duration `toml:"maxRetryDelay"`
+	// MaxAge is how long we keep retrying a delivery before giving up
+	MaxAge time.Duration `toml:"maxAge"`
+	// Workers is how many deliveries can be in progress at the same time
+	Workers int `toml:"workers"`
+	// PerHost is how many deliveries to the same host can be in
+	// progress at the same time
+	PerHost int `toml:"perHost"`
+}
+
+// DefaultConfig returns the configuration with all the defaults
+// filled in except for BaseURL
+func DefaultConfig() Config {
+	return Config{
+		Storage:        "storage",
+		StorageType:    "filesystem",
+		UserAgent:      "activityserve",
+		ListenAddress:  ":8081",
+		RequestTimeout: 30 * time.Second,
+		MaxClockSkew:   12 * time.Hour,
+		FollowMoves:    true,
+		Delivery: DeliveryConfig{
+			RetryDelay:    30 * time.Second,
+			MaxRetryDelay: 6 * time.Hour,
+			MaxAge:        48 * time.Hour,
+			Workers:       8,
+			PerHost:       2,
+		},
+	}
+}
+
+// LoadConfig reads the configuration from filename on top of the
+// defaults. Files ending in .toml are read as TOML, anything else as INI
+func LoadConfig(filename string) (Config, error) {
+	config, _, err := loadConfigFile(filename)
+	return config, err
+}
+
+// loadConfigFile also returns the parsed file if it's INI so that Setup
+// can hand it to applications that keep their own settings in it
+func loadConfigFile(filename string) (Config, *ini.File, error) {
+	if strings.ToLower(filepath.Ext(filename)) == ".toml" {
+		config, err := loadTOMLConfig(filename)
+		return config, nil, err
+	}
+	return loadINIConfig(filename)
+}
+
+func loadTOMLConfig(filename string) (Config, error) {
+	config := DefaultConfig()
+	sections := struct {
+		General  *Config         `toml:"general"`
+		Delivery *DeliveryConfig `toml:"delivery"`
+	}{&config, &config.Delivery}
+	_, err := toml.DecodeFile(filename, &sections)
+	if err != nil {
+		return config, fmt.Errorf("can't read configuration file %s: %v", filename, err)
+	}
+	return config, nil
+}
+
+func loadINIConfig(filename string) (Config, *ini.File, error) {
+	config := DefaultConfig()
+	cfg, err := ini.Load(filename)
+	if err != nil {
+		return config, nil, fmt.Errorf("can't read configuration file %s: %v", filename, err)
+	}
+
+	general := cfg.Section("general")
+	config.BaseURL = general.Key("baseURL").MustString(config.BaseURL)
+	config.Storage = general.Key("storage").MustString(config.Storage)
+	config.StorageType = general.Key("storageType").MustString(config.StorageType)
+	config.UserAgent = general.Key("userAgent").MustString(config.UserAgent)
+	config.ListenAddress = general.Key("listen").MustString(config.ListenAddress)
+	config.FollowMoves = general.Key("followMoves").MustBool(config.FollowMoves)
+	config.TagsURL = general.Key("tagsURL").MustString(config.TagsURL)
+	config.Debug = general.Key("debug").MustBool(config.Debug)
+
+	delivery := cfg.Section("delivery")
+	config.Delivery.Workers = delivery.Key("workers").MustInt(config.Delivery.Workers)
+	config.Delivery.PerHost = delivery.Key("perHost").MustInt(config.Delivery.PerHost)
+
+	// ini's MustDuration silently falls back to the default on a typo,
+	// we'd rather tell our users
+	durations := []struct {
+		key   *ini.Key
+		value *time.Duration
+	}{
+		{general.Key("requestTimeout"), &config.RequestTimeout},
+		{general.Key("maxClockSkew"), &config.MaxClockSkew},
+		{delivery.Key("retryDelay"), &config.Delivery.RetryDelay},
+		{delivery.Key("maxRetryDelay"), &config.Delivery.MaxRetryDelay},
+		{delivery.Key("maxAge"), &config.Delivery.MaxAge},
+	}
+	for _, d := range durations {
+		if d.key.String() == "" {
+			continue
+		}
+		*d.value, err = d.key.Duration()
+		if err != nil {
+			return config, cfg, fmt.Errorf("%s: can't parse %q as a duration (e.g. 30s, 12h)", d.key.Name(), d.key.String())
+		}
+	}
+	return config, cfg, nil
+}
+
+// the prefix of the environment variables LoadEnv looks at
+const envPrefix = "ACTIVITYSERVE_"
+
+// LoadEnv overrides the configuration with the environment variables
+// that are set, e.g. ACTIVITYSERVE_BASE_URL or ACTIVITYSERVE_DELIVERY_WORKERS
+func (c *Config) LoadEnv() error {
+	strs := map[string]*string{
+		"BASE_URL":     &c.BaseURL,
+		"STORAGE":      &c.Storage,
+		"STORAGE_TYPE": &c.StorageType,
+		"USER_AGENT":   &c.UserAgent,
+		"LISTEN":       &c.ListenAddress,
+		"TAGS_URL":     &c.TagsURL,
+	}
+	for name, value := range strs {
+		if env, ok := os.LookupEnv(envPrefix + name); ok {
+			*value = env
+		}
+	}
+
+	durations := map[string]*time.Duration{
+		"REQUEST_TIMEOUT":          &c.RequestTimeout,
+		"MAX_CLOCK_SKEW":           &c.MaxClockSkew,
+		"DELIVERY_RETRY_DELAY":     &c.Delivery.RetryDelay,
+		"DELIVERY_MAX_RETRY_DELAY": &c.Delivery.MaxRetryDelay,
+		"DELIVERY_MAX_AGE":         &c.Delivery.MaxAge,
+	}
+	for name, value := range durations {
+		if env, ok := os.LookupEnv(envPrefix + name); ok {
+			d, err := time.ParseDuration(env)
+			if err != nil {
+				return fmt.Errorf("%s%s: can't parse %q as a duration (e.g. 30s, 12h)", envPrefix, name, env)
+			}
+			*value = d
+		}
+	}
+
+	ints := map[string]*int{
+		"DELIVERY_WORKERS":  &c.Delivery.Workers,
+		"DELIVERY_PER_HOST": &c.Delivery.PerHost,
+	}
+	for name, value := range ints {
+		if env, ok := os.LookupEnv(envPrefix + name); ok {
+			n, err := strconv.Atoi(env)
+			if err != nil {
+				return fmt.Errorf("%s%s: can't parse %q as a number", envPrefix, name, env)
+			}
+			*value = n
+		}
+	}
+
+	bools := map[string]*bool{
+		"FOLLOW_MOVES": &c.FollowMoves,
+		"DEBUG":        &c.Debug,
+	}
+	for name, value := range bools {
+		if env, ok := os.LookupEnv(envPrefix + name); ok {
+			b, err := strconv.ParseBool(env)
+			if err != nil {
+				return fmt.Errorf("%s%s: can't parse %q as true or false", envPrefix, name, env)
+			}
+			*value = b
+		}
+	}
+	return nil
+}
+
+// Validate checks that the configuration makes sense and returns all
+// the problems it finds
+func (c Config) Validate() error {
+	var errs []error
+	if c.BaseURL == "" {
+		errs = append(errs, errors.New("baseURL is not set"))
+	} else if u, err := url.Parse(c.BaseURL); err != nil {
+		errs = append(errs, fmt.Errorf("baseURL %q is not a valid url: %v", c.BaseURL, err))
+	} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		errs = append(errs, fmt.Errorf("baseURL %q should look like https://example.com/", c.BaseURL))
+	}
+	if c.TagsURL != "" {
+		if u, err := url.Parse(c.TagsURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("tagsURL %q should look like https://example.com/tags/", c.TagsURL))
+		}
+	}
+	if c.Storage == "" {
+		errs = append(errs, errors.New("storage is not set"))
+	}
+	if c.StorageType != "filesystem" && c.StorageType != "sqlite" {
+		errs = append(errs, fmt.Errorf("unknown storageType %q, use filesystem or sqlite", c.StorageType))
+	}
+	if c.ListenAddress == "" {
+		errs = append(errs, errors.New("listen address is not set"))
+	}
+	durations := []struct {
+		name  string
+		value time.Duration
+	}{
+		{"requestTimeout", c.RequestTimeout},
+		{"maxClockSkew", c.MaxClockSkew},
+		{"delivery retryDelay", c.Delivery.RetryDelay},
+		{"delivery maxRetryDelay", c.Delivery.MaxRetryDelay},
+		{"delivery maxAge", c.Delivery.MaxAge},
+	}
+	for _, d := range durations {
+		if d.value <= 0 {
+			errs = append(errs, fmt.Errorf("%s should be positive, got %s", d.name, d.value))
+		}
+	}
+	if c.Delivery.RetryDelay > c.Delivery.MaxRetryDelay {
+		errs = append(errs, fmt.Errorf("delivery retryDelay (%s) is longer than maxRetryDelay (%s)", c.Delivery.RetryDelay, c.Delivery.MaxRetryDelay))
+	}
+	if c.Delivery.Workers < 1 {
+		errs = append(errs, fmt.Errorf("delivery workers should be at least 1, got %d", c.Delivery.Workers))
+	}
+	if c.Delivery.PerHost < 1 {
+		errs = append(errs, fmt.Errorf("delivery perHost should be at least 1, got %d", c.Delivery.PerHost))
+	}
+	return errors.Join(errs...)
+}
+
+// openStore opens the storage backend the configuration asks for, json
+// files in the storage directory or a single sqlite database in it
+func (c Config) openStore() (Store, error) {
+	switch c.StorageType {
+	case "filesystem":
+		return NewFileStore(c.Storage), nil
+	case "sqlite":
+		err := os.MkdirAll(c.Storage, 0755)
+		if err != nil {
+			return nil, err
+		}
+		sqliteStore, err := NewSQLiteStore(c.Storage + slash + "activityserve.db")
+		if err != nil {
+			return nil, fmt.Errorf("can't open sqlite database: %v", err)
+		}
+		return sqliteStore, nil
+	}
+	return nil, fmt.Errorf("unknown storage type %q", c.StorageType)
+}
@@ -0,0 +1,196 @@
+package activityserve
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/gologme/log"
+)
+
+// @user@host preceded by the start of the content, whitespace or the end
+// of an html tag so that we don't pick up email addresses or urls
+var mentionRegexp = regexp.MustCompile(`(^|[\s>(])@([\w.-]+)@([\w-]+(?:\.[\w-]+)*(?::\d+)?)`)
+
+// #tag with the same rules as mentions so that we don't pick up anchors
+var hashtagRegexp = regexp.MustCompile(`(^|[\s>(])#([\p{L}\p{N}_]*\p{L}[\p{L}\p{N}_]*)`)
+
+// parseContent finds the @user@host mentions and #hashtags in the content
+// of a note and turns them into links. It returns the new content, the
+// Mention and Hashtag tags for the note and the iris of the mentioned
+// actors. Mentions we can't resolve are left alone, and so is whatever is
+// in an html tag or already a link
+func (a *Actor) parseContent(content string) (string, Links, []string) {
+	tags := make(Links, 0)
+	mentioned := make([]string, 0)
+	resolved := make(map[string]*RemoteActor)
+
+	content = replaceInText(content, mentionRegexp, func(match string) string {
+		parts := mentionRegexp.FindStringSubmatch(match)
+		prefix, user, host := parts[1], parts[2], strings.ToLower(parts[3])
+		handle := "@" + user + "@" + host
+		remote, ok := resolved[handle]
+		if !ok {
+			iri, err := a.instance.webfinger(user, host)
+			if err == nil {
+				var r RemoteActor
+				r, err = a.instance.NewRemoteActor(iri)
+				remote = &r
+			}
+			if err != nil {
+				log.Info("Can't resolve " + handle)
+				log.Info(err)
+				remote = nil
+			}
+			resolved[handle] = remote
+			if remote != nil {
+				tags = append(tags, Link{Type: "Mention", Href: remote.iri, Name: handle})
+				mentioned = append(mentioned, remote.iri)
+			}
+		}
+		if remote == nil {
+			return match
+		}
+		profile := remote.url
+		if profile == "" {
+			profile = remote.iri
+		}
+		return prefix + `<span class="h-card"><a href="` + html.EscapeString(profile) +
+			`" class="u-url mention">@<span>` + html.EscapeString(user) + `</span></a></span>`
+	})
+
+	seen := make(map[string]bool)
+	content = replaceInText(content, hashtagRegexp, func(match string) string {
+		parts := hashtagRegexp.FindStringSubmatch(match)
+		prefix, tag := parts[1], parts[2]
+		// we don't have tag pages of our own, the application may
+		href := ""
+		if a.instance.tagsURL != "" {
+			href = a.instance.tagsURL + url.PathEscape(strings.ToLower(tag))
+		}
+		if !seen[strings.ToLower(tag)] {
+			seen[strings.ToLower(tag)] = true
+			tags = append(tags, Link{Type: "Hashtag", Href: href, Name: "#" + tag})
+		}
+		if href == "" {
+			return match
+		}
+		return prefix + `<a href="` + html.EscapeString(href) + `" class="mention hashtag" rel="tag">#<span>` + tag + `</span></a>`
+	})
+
+	return content, tags, mentioned
+}
+
+// replaceInText replaces the matches of re in the text of some html
+// with what repl returns for them, leaving alone the tags themselves
+// (e.g. a color in a style) and the text of links
+func replaceInText(content string, re *regexp.Regexp, repl func(string) string) string {
+	var b strings.Builder
+	inLink := 0
+	for content != "" {
+		text, tag := content, ""
+		if start := strings.IndexByte(content, '<'); start >= 0 {
+			if end := strings.IndexByte(content[start:], '>'); end >= 0 {
+				text, tag = content[:start], content[start:start+end+1]
+			}
+		}
+		content = content[len(text)+len(tag):]
+
+		if inLink == 0 {
+			text = re.ReplaceAllStringFunc(text, repl)
+		}
+		b.WriteString(text)
+		b.WriteString(tag)
+
+		switch tagName(tag) {
+		case "a":
+			inLink++
+		case "/a":
+			if inLink > 0 {
+				inLink--
+			}
+		}
+	}
+	return b.String()
+}
+
+// tagName returns the lowercase name of an html tag, with a leading
+// slash for closing tags
+func tagName(tag string) string {
+	name := strings.TrimPrefix(tag, "<")
+	closing := strings.HasPrefix(name, "/")
+	name = strings.TrimPrefix(name, "/")
+	if i := strings.IndexAny(name, " \t\n\r/>"); i >= 0 {
+		name = name[:i]
+	}
+	if closing {
+		name = "/" + name
+	}
+	return strings.ToLower(name)
+}
+
+// webfinger looks up the iri of the actor user@host. Answers are cached
+// along with the other foreign objects
+func (i *Instance) webfinger(user, host string) (string, error) {
+	resource := "acct:" + user + "@" + host
+	jrd, err := i.store.LoadForeign(resource)
+	if err != nil {
+		jrd, err = i.fetchWebfinger(resource, host)
+		if err != nil {
+			return "", err
+		}
+		err = i.store.SaveForeign(resource, jrd)
+		if err != nil {
+			log.Info("Couldn't cache " + resource)
+			log.Info(err)
+		}
+	}
+
+	links, _ := jrd["links"].([]interface{})
+	for _, l := range links {
+		link, ok := l.(map[string]interface{})
+		if !ok || link["rel"] != "self" {
+			continue
+		}
+		linkType, _ := link["type"].(string)
+		href, _ := link["href"].(string)
+		if href != "" && (linkType == "application/activity+json" ||
+			strings.HasPrefix(linkType, "application/ld+json")) {
+			return href, nil
+		}
+	}
+	return "", errors.New("no actor found for " + resource)
+}
+
+func (i *Instance) fetchWebfinger(resource, host string) (map[string]interface{}, error) {
+	address := "https://" + host + "/.well-known/webfinger?resource=" + url.QueryEscape(resource)
+	req, err := http.NewRequest("GET", address, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Accept", "application/jrd+json, application/json")
+	req.Header.Add("User-Agent", i.userAgent+" "+version)
+
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if !isSuccess(resp.StatusCode) {
+		return nil, fmt.Errorf("webfinger request to %s failed (%d)", address, resp.StatusCode)
+	}
+
+	var jrd map[string]interface{}
+	err = json.Unmarshal(body, &jrd)
+	return jrd, err
+}
@@ -0,0 +1,72 @@
+package activityserve
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHashtags(t *testing.T) {
+	i := newTestInstance(t)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without a tags url the hashtags are tagged but not linked
+	content, tags, _ := actor.parseContent("#Go and #rust and #go")
+	if content != "#Go and #rust and #go" {
+		t.Errorf("got content %q", content)
+	}
+	if len(tags) != 2 || tags[0].Name != "#Go" || tags[1].Name != "#rust" || tags[0].Href != "" {
+		t.Errorf("got tags %+v", tags)
+	}
+
+	i.SetTagsURL("https://local.example/tags/")
+	content, tags, _ = actor.parseContent("#Go and #rust")
+	if !strings.Contains(content, `<a href="https://local.example/tags/go" class="mention hashtag" rel="tag">#<span>Go</span></a>`) {
+		t.Errorf("got content %q", content)
+	}
+	if len(tags) != 2 || tags[0].Href != "https://local.example/tags/go" || tags[1].Href != "https://local.example/tags/rust" {
+		t.Errorf("got tags %+v", tags)
+	}
+
+	// publishing doesn't take tags without an href for the same one
+	options := NoteOptions{Tag: Links{{Type: "Hashtag", Name: "#go"}}}
+	for _, tag := range []Link{{Type: "Hashtag", Name: "#Go"}, {Type: "Hashtag", Name: "#rust"}} {
+		if !options.Tag.contains(tag) {
+			options.Tag = append(options.Tag, tag)
+		}
+	}
+	if len(options.Tag) != 2 {
+		t.Errorf("got tags %+v", options.Tag)
+	}
+}
+
+func TestHashtagsOnlyInText(t *testing.T) {
+	i := newTestInstance(t)
+	i.SetTagsURL("https://local.example/tags/")
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		content string
+		want    string
+		tags    int
+	}{
+		{`<span style="color: #ff0000">red</span>`, `<span style="color: #ff0000">red</span>`, 0},
+		{`<a href="https://remote.example/tags/go">#go</a>`, `<a href="https://remote.example/tags/go">#go</a>`, 0},
+		{`<a href="https://x.example/"><b>#go</b></a> #go`, `<a href="https://x.example/"><b>#go</b></a> <a href="https://local.example/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a>`, 1},
+		{`<p>#go</p>`, `<p><a href="https://local.example/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a></p>`, 1},
+		{`1 < 2 #go`, `1 < 2 <a href="https://local.example/tags/go" class="mention hashtag" rel="tag">#<span>go</span></a>`, 1},
+	}
+	for _, test := range tests {
+		content, tags, _ := actor.parseContent(test.content)
+		if content != test.want {
+			t.Errorf("%s: got %s", test.content, content)
+		}
+		if len(tags) != test.tags {
+			t.Errorf("%s: got tags %+v", test.content, tags)
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package activityserve
+
+import (
+	"encoding/json"
+	"errors"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/dchest/uniuri"
+	"github.com/gologme/log"
+)
+
+// DeliveryJob is an activity waiting to be delivered to a remote inbox.
+// Jobs are persisted in the Store so that they survive restarts and are
+// retried with exponential backoff until they succeed or get too old,
+// in which case they end up in the dead letter list.
+type DeliveryJob struct {
+	ID          string
+	Actor       string // the name of the local actor that signs the request
+	Inbox       string
+	Activity    json.RawMessage
+	Attempts    int
+	Created     time.Time
+	NextAttempt time.Time
+	LastError   string
+}
+
+// deliveryPool keeps track of the jobs the workers are busy with
+type deliveryPool struct {
+	startOnce sync.Once
+	// wakes the delivery dispatcher up when a new job is queued or
+	// a worker becomes available
+	wake chan struct{}
+
+	mu       sync.Mutex
+	inFlight map[string]bool
+	perHost  map[string]int
+	// jobs finished since the dispatcher last read the queue, they
+	// might still be in the (stale) list it's going through
+	finished map[string]bool
+	jobs     chan *DeliveryJob
+}
+
+func newDeliveryPool() *deliveryPool {
+	return &deliveryPool{
+		wake:     make(chan struct{}, 1),
+		inFlight: make(map[string]bool),
+		perHost:  make(map[string]int),
+		finished: make(map[string]bool),
+	}
+}
+
+// deliver queues an activity for delivery to inbox on behalf of the actor
+func (a *Actor) deliver(activity interface{}, inbox string) error {
+	err := checkInbox(inbox)
+	if err != nil {
+		log.Info(err)
+		return err
+	}
+	b, err := json.Marshal(activity)
+	if err != nil {
+		log.Info("Can't marshal JSON")
+		log.Info(err)
+		return err
+	}
+	now := time.Now()
+	job := &DeliveryJob{
+		ID:          uniuri.New(),
+		Actor:       a.Name,
+		Inbox:       inbox,
+		Activity:    b,
+		Created:     now,
+		NextAttempt: now,
+	}
+	err = a.instance.store.SaveDelivery(job)
+	if err != nil {
+		log.Info("Couldn't queue delivery to " + inbox)
+		log.Info(err)
+		return err
+	}
+	a.instance.startDeliveries()
+	a.instance.deliveries.wakeUp()
+	return nil
+}
+
+// checkInbox makes sure we can deliver to an inbox at all, there's no
+// point in retrying for days to post to an inbox we don't know
+func checkInbox(inbox string) error {
+	u, err := url.Parse(inbox)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("can't deliver to the invalid inbox \"" + inbox + "\"")
+	}
+	return nil
+}
+
+// wakeUp makes the dispatcher look at the queue without
+// waiting for the next poll
+func (p *deliveryPool) wakeUp() {
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+// startDeliveries starts the workers and the dispatcher that feeds
+// them from the delivery queue, if they're not already running
+func (i *Instance) startDeliveries() {
+	i.deliveries.startOnce.Do(func() {
+		i.deliveries.jobs = make(chan *DeliveryJob)
+		for w := 0; w < i.deliveryWorkers; w++ {
+			go i.deliveryWorker()
+		}
+		go i.runDeliveries()
+	})
+}
+
+// how many due jobs the dispatcher reads from the queue at a time
+const deliveryPageSize = 100
+
+// runDeliveries periodically goes through the jobs that are due and
+// hands them to the workers. It blocks while all the workers are
+// busy, which is fine as the jobs wait safely in the store
+func (i *Instance) runDeliveries() {
+	deliveries := i.deliveries
+	ticker := time.NewTicker(i.deliveryPollInterval)
+	defer ticker.Stop()
+	for {
+		deliveries.mu.Lock()
+		deliveries.finished = make(map[string]bool)
+		deliveries.mu.Unlock()
+
+		// go through all the due jobs rather than just the oldest ones,
+		// which might all be waiting for the same busy host
+		dispatched := 0
+		for offset := 0; ; offset += deliveryPageSize {
+			jobs, err := i.store.DueDeliveries(time.Now(), offset, deliveryPageSize)
+			if err != nil {
+				log.Info("Can't read the delivery queue")
+				log.Info(err)
+				break
+			}
+			for _, job := range jobs {
+				if deliveries.claim(job, i.deliveryPerHost) {
+					deliveries.jobs <- job
+					dispatched++
+				}
+			}
+			if len(jobs) < deliveryPageSize {
+				break
+			}
+		}
+		// if we handed anything out there might be more waiting
+		if dispatched > 0 {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-deliveries.wake:
+		}
+	}
+}
+
+// claim marks a job as in progress unless it's already being worked on
+// or its host has reached the limit of concurrent deliveries
+func (p *deliveryPool) claim(job *DeliveryJob, perHost int) bool {
+	host := jobHost(job)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.inFlight[job.ID] || p.finished[job.ID] || p.perHost[host] >= perHost {
+		return false
+	}
+	p.inFlight[job.ID] = true
+	p.perHost[host]++
+	return true
+}
+
+// release marks a job as done and lets the dispatcher know
+// that there's a worker available
+func (p *deliveryPool) release(job *DeliveryJob) {
+	host := jobHost(job)
+	p.mu.Lock()
+	delete(p.inFlight, job.ID)
+	p.finished[job.ID] = true
+	p.perHost[host]--
+	if p.perHost[host] <= 0 {
+		delete(p.perHost, host)
+	}
+	p.mu.Unlock()
+	p.wakeUp()
+}
+
+func jobHost(job *DeliveryJob) string {
+	inbox, err := url.Parse(job.Inbox)
+	if err != nil {
+		return job.Inbox
+	}
+	return inbox.Host
+}
+
+// deliveryWorker delivers the jobs handed to it by the dispatcher
+func (i *Instance) deliveryWorker() {
+	for job := range i.deliveries.jobs {
+		i.attemptDelivery(job)
+		i.deliveries.release(job)
+	}
+}
+
+// attemptDelivery tries to post a job once and then either removes it
+// from the queue, schedules a retry or moves it to the dead letters
+func (i *Instance) attemptDelivery(job *DeliveryJob) {
+	// jobs queued by older versions may not have a valid inbox
+	err := checkInbox(job.Inbox)
+	if err != nil {
+		job.LastError = err.Error()
+		log.Info("Giving up delivering to " + job.Inbox)
+		err = i.store.SaveDeadLetter(job)
+		if err != nil {
+			log.Info(err)
+		}
+		return
+	}
+	key, err := i.signingKey(job.Actor)
+	if err == nil {
+		err = i.signedHTTPPost(key, job.Activity, job.Inbox)
+	}
+	if err == nil {
+		err = i.store.DeleteDelivery(job.ID)
+		if err != nil {
+			log.Info("Couldn't remove delivered job " + job.ID + " from the queue")
+			log.Info(err)
+		}
+		return
+	}
+
+	job.Attempts++
+	job.LastError = err.Error()
+	if permanentFailure(err) || time.Since(job.Created) > i.deliveryMaxAge {
+		log.Info("Giving up delivering to " + job.Inbox)
+		err = i.store.SaveDeadLetter(job)
+		if err != nil {
+			log.Info(err)
+		}
+		return
+	}
+	job.NextAttempt = time.Now().Add(i.retryDelay(job.Attempts))
+	log.Info("Failed to deliver message to " + job.Inbox + ", will retry at " + job.NextAttempt.Format(time.RFC3339))
+	err = i.store.SaveDelivery(job)
+	if err != nil {
+		log.Info(err)
+	}
+}
+
+// retryDelay returns how long to wait before the next attempt, growing
+// exponentially with the number of attempts and with some jitter so
+// that retries to the same server don't all happen at once
+func (i *Instance) retryDelay(attempts int) time.Duration {
+	delay := i.deliveryMaxRetryDelay
+	if attempts < 32 {
+		delay = i.deliveryRetryDelay << uint(attempts-1)
+	}
+	if delay > i.deliveryMaxRetryDelay || delay <= 0 {
+		delay = i.deliveryMaxRetryDelay
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2 + 1))
+	return delay/2 + delay/4 + jitter
+}
+
+// permanentFailure tells whether there's no point in retrying a
+// delivery, e.g. because the inbox doesn't exist any more. Other client
+// errors are retried: servers answer 401 or 403 when they can't fetch our
+// key for the moment, and who knows what else for other passing troubles
+func permanentFailure(err error) bool {
+	statusErr, ok := err.(*httpStatusError)
+	if !ok {
+		return false
+	}
+	switch statusErr.code {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusGone, http.StatusUnprocessableEntity:
+		return true
+	}
+	return false
+}
+
+// DeadLetters returns the deliveries the default instance gave up on
+func DeadLetters() ([]*DeliveryJob, error) {
+	return defaultInstance.DeadLetters()
+}
+
+// DeadLetters returns the deliveries we gave up on
+func (i *Instance) DeadLetters() ([]*DeliveryJob, error) {
+	return i.store.DeadLetters()
+}
@@ -0,0 +1,122 @@
+package activityserve
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeliveriesDontWaitForBusyHosts(t *testing.T) {
+	// a host that doesn't answer until the test is over
+	stuck := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stuck
+	}))
+	defer slow.Close()
+	defer close(stuck)
+
+	delivered := make(chan struct{}, 1)
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		delivered <- struct{}{}
+	}))
+	defer fast.Close()
+
+	// the workers keep retrying after the test so t.TempDir can't
+	// clean up after them
+	dir, err := os.MkdirTemp("", "activityserve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	i := NewInstance("https://local.example/", NewFileStore(dir))
+	i.deliveryWorkers = 4
+	i.deliveryPerHost = 1
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// more jobs for the slow host than the dispatcher reads at a
+	// time, all of them older than the one for the fast host
+	for n := 0; n < deliveryPageSize*2; n++ {
+		err = actor.deliver(map[string]string{"type": "Note"}, slow.URL+"/inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = actor.deliver(map[string]string{"type": "Note"}, fast.URL+"/inbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-delivered:
+	case <-time.After(i.deliveryPollInterval / 2):
+		t.Fatal("the delivery to the fast host waited behind the slow one")
+	}
+}
+
+func TestDeliverRejectsInvalidInboxes(t *testing.T) {
+	i := newTestInstance(t)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, inbox := range []string{"", "inbox", "/users/bob/inbox", "mailto:bob@remote.example", "https://"} {
+		err = actor.deliver(map[string]string{"type": "Note"}, inbox)
+		if err == nil {
+			t.Errorf("%q was queued", inbox)
+		}
+	}
+	jobs, err := i.store.DueDeliveries(time.Now(), 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jobs) != 0 {
+		t.Fatalf("%d jobs were queued", len(jobs))
+	}
+}
+
+// countingStore counts the actors loaded from the store
+type countingStore struct {
+	Store
+	loads int32
+}
+
+func (s *countingStore) LoadActor(name string) (*ActorToSave, error) {
+	atomic.AddInt32(&s.loads, 1)
+	return s.Store.LoadActor(name)
+}
+
+func TestDeliveriesDontLoadTheActor(t *testing.T) {
+	base, received := inboxServer(t)
+	i := newDeliveringInstance(t)
+	store := &countingStore{Store: i.store}
+	i.SetStore(store)
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const jobs = 5
+	for n := 0; n < jobs; n++ {
+		err = actor.deliver(map[string]string{"type": "Note"}, base+"/users/bob/inbox")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	timeout := time.After(5 * time.Second)
+	for n := 0; n < jobs; n++ {
+		select {
+		case <-received:
+		case <-timeout:
+			t.Fatalf("only %d of the jobs were delivered", n)
+		}
+	}
+	if loads := atomic.LoadInt32(&store.loads); loads > 1 {
+		t.Fatalf("the actor was loaded %d times for %d deliveries", loads, jobs)
+	}
+}
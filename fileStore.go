@@ -0,0 +1,379 @@
+package activityserve
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+)
+
+// FileStore is the default Store. It keeps everything as JSON files
+// in a directory with the following layout:
+//
+//	actors/<name>/<name>.json     the actor with its followers etc.
+//	actors/<name>/items/<hash>.json
+//	actors/<name>/outbox.txt      one activity id per line
+//	foreign/<sha256 of iri>.json
+//	queue/<id>.json               deliveries waiting to be sent
+//	deadletters/<id>.json         deliveries we gave up on
+//
+// The delivery queue is read from disk once and then kept in memory, so
+// only one FileStore should use a directory at a time.
+type FileStore struct {
+	dir string
+
+	queueMu sync.Mutex
+	// the jobs in queue/ by id, nil until we read them
+	queue map[string]*DeliveryJob
+}
+
+// NewFileStore returns a FileStore rooted at dir, creating the
+// directories it needs
+func NewFileStore(dir string) *FileStore {
+	// prepare storage for foreign activities (activities we store that don't
+	// belong to us)
+	foreignDir := dir + slash + "foreign"
+	if _, err := os.Stat(foreignDir); os.IsNotExist(err) {
+		os.MkdirAll(foreignDir, 0755)
+	}
+	return &FileStore{dir: dir}
+}
+
+func (fs *FileStore) actorDir(name string) string {
+	return fs.dir + slash + "actors" + slash + name
+}
+
+// SaveActor writes the actor to <name>.json
+func (fs *FileStore) SaveActor(actor *ActorToSave) error {
+	if !safeName(actor.Name) {
+		return errors.New("Illegal characters in actor name")
+	}
+	// check if we already have a directory to save actors
+	// and if not, create it
+	dir := fs.actorDir(actor.Name) + slash + "items"
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.MkdirAll(dir, 0755)
+	}
+
+	actorJSON, err := json.MarshalIndent(actor, "", "\t")
+	if err != nil {
+		log.Info("error Marshalling actor json")
+		return err
+	}
+	err = ioutil.WriteFile(fs.actorDir(actor.Name)+slash+actor.Name+".json", actorJSON, 0644)
+	if err != nil {
+		log.Printf("WriteFileJson ERROR: %+v", err)
+		return err
+	}
+	return nil
+}
+
+// LoadActor reads the actor from <name>.json
+func (fs *FileStore) LoadActor(name string) (*ActorToSave, error) {
+	if !safeName(name) {
+		return nil, errors.New("Illegal characters in actor name")
+	}
+	actor := &ActorToSave{}
+	err := fs.readJSON(fs.actorDir(name)+slash+name+".json", actor)
+	if err != nil {
+		return nil, err
+	}
+	return actor, nil
+}
+
+// ActorNames lists the directories in actors/
+func (fs *FileStore) ActorNames() ([]string, error) {
+	dirs, err := ioutil.ReadDir(fs.dir + slash + "actors")
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(dirs))
+	for _, dir := range dirs {
+		if dir.IsDir() && safeName(dir.Name()) {
+			names = append(names, dir.Name())
+		}
+	}
+	return names, nil
+}
+
+// SaveItem writes the item to items/<hash>.json
+func (fs *FileStore) SaveItem(actor, hash string, item interface{}) error {
+	if !safeName(actor) || !safeName(hash) {
+		return errors.New("Illegal characters in item name")
+	}
+	JSON, _ := json.MarshalIndent(item, "", "\t")
+
+	dir := fs.actorDir(actor) + slash + "items"
+	err := ioutil.WriteFile(dir+slash+hash+".json", JSON, 0644)
+	if err != nil {
+		log.Printf("WriteFileJson ERROR: %+v", err)
+		return err
+	}
+	return nil
+}
+
+// LoadItem reads the item from items/<hash>.json
+func (fs *FileStore) LoadItem(actor, hash string) (map[string]interface{}, error) {
+	if !safeName(actor) || !safeName(hash) {
+		return nil, ErrNotFound
+	}
+	var item map[string]interface{}
+	err := fs.readJSON(fs.actorDir(actor)+slash+"items"+slash+hash+".json", &item)
+	return item, err
+}
+
+// AppendToOutbox adds a new line with the iri to outbox.txt
+func (fs *FileStore) AppendToOutbox(actor, iri string) error {
+	// create outbox file if it doesn't exist
+	outboxFilePath := fs.actorDir(actor) + slash + "outbox.txt"
+	outbox, err := os.OpenFile(outboxFilePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Info("Cannot create or open outbox file")
+		log.Info(err)
+		return err
+	}
+	defer outbox.Close()
+
+	_, err = outbox.Write([]byte(iri + "\n"))
+	return err
+}
+
+// RemoveFromOutbox rewrites outbox.txt without the lines with the iri
+func (fs *FileStore) RemoveFromOutbox(actor, iri string) error {
+	outboxFilePath := fs.actorDir(actor) + slash + "outbox.txt"
+	outbox, err := ioutil.ReadFile(outboxFilePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(outbox), "\n")
+	kept := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if strings.TrimSpace(line) != iri {
+			kept = append(kept, line)
+		}
+	}
+	// write to a temporary file first so that we don't lose the
+	// outbox if something goes wrong halfway
+	err = ioutil.WriteFile(outboxFilePath+".tmp", []byte(strings.Join(kept, "")), 0644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(outboxFilePath+".tmp", outboxFilePath)
+}
+
+// OutboxCount counts the lines of outbox.txt
+func (fs *FileStore) OutboxCount(actor string) (int, error) {
+	return lineCounter(fs.actorDir(actor) + slash + "outbox.txt")
+}
+
+// Outbox reads limit lines of outbox.txt starting after offset
+func (fs *FileStore) Outbox(actor string, offset, limit int) ([]string, error) {
+	// ReadLines counts lines from 1
+	return ReadLines(fs.actorDir(actor)+slash+"outbox.txt", offset+1, offset+limit)
+}
+
+// foreignFile returns the file we cache a foreign object in. iris
+// can contain anything so we name the files after their hash
+func (fs *FileStore) foreignFile(iri string) string {
+	sum := sha256.Sum256([]byte(iri))
+	return fs.dir + slash + "foreign" + slash + hex.EncodeToString(sum[:]) + ".json"
+}
+
+// SaveForeign writes the object to foreign/
+func (fs *FileStore) SaveForeign(iri string, object map[string]interface{}) error {
+	JSON, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fs.foreignFile(iri), JSON, 0644)
+}
+
+// LoadForeign reads the object from foreign/
+func (fs *FileStore) LoadForeign(iri string) (map[string]interface{}, error) {
+	var object map[string]interface{}
+	err := fs.readJSON(fs.foreignFile(iri), &object)
+	return object, err
+}
+
+// DeleteForeign removes the object from foreign/
+func (fs *FileStore) DeleteForeign(iri string) error {
+	err := os.Remove(fs.foreignFile(iri))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// writeJob writes a delivery job in one of the queue directories
+func (fs *FileStore) writeJob(queue string, job *DeliveryJob) error {
+	if !safeName(job.ID) {
+		return errors.New("Illegal characters in job id")
+	}
+	dir := fs.dir + slash + queue
+	if _, err := os.Stat(dir); os.IsNotExist(err) {
+		os.MkdirAll(dir, 0755)
+	}
+	JSON, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dir+slash+job.ID+".json", JSON, 0644)
+}
+
+// readJobs reads all the jobs in one of the queue directories
+func (fs *FileStore) readJobs(queue string) ([]*DeliveryJob, error) {
+	dir := fs.dir + slash + queue
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*DeliveryJob, 0, len(files))
+	for _, file := range files {
+		job := &DeliveryJob{}
+		err = fs.readJSON(dir+slash+file.Name(), job)
+		if err != nil {
+			log.Info("Can't read delivery job " + file.Name())
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// loadQueue reads queue/ into memory the first time it's needed.
+// It must be called with queueMu held
+func (fs *FileStore) loadQueue() error {
+	if fs.queue != nil {
+		return nil
+	}
+	jobs, err := fs.readJobs("queue")
+	if err != nil {
+		return err
+	}
+	fs.queue = make(map[string]*DeliveryJob, len(jobs))
+	for _, job := range jobs {
+		fs.queue[job.ID] = job
+	}
+	return nil
+}
+
+// SaveDelivery writes the job to queue/
+func (fs *FileStore) SaveDelivery(job *DeliveryJob) error {
+	fs.queueMu.Lock()
+	defer fs.queueMu.Unlock()
+	err := fs.loadQueue()
+	if err != nil {
+		return err
+	}
+	err = fs.writeJob("queue", job)
+	if err != nil {
+		return err
+	}
+	saved := *job
+	fs.queue[job.ID] = &saved
+	return nil
+}
+
+// DueDeliveries returns the jobs in queue/ that are due, the ones that
+// have been waiting longest first
+func (fs *FileStore) DueDeliveries(before time.Time, offset, limit int) ([]*DeliveryJob, error) {
+	fs.queueMu.Lock()
+	defer fs.queueMu.Unlock()
+	err := fs.loadQueue()
+	if err != nil {
+		return nil, err
+	}
+	due := make([]*DeliveryJob, 0)
+	for _, job := range fs.queue {
+		if !job.NextAttempt.After(before) {
+			due = append(due, job)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		if due[i].NextAttempt.Equal(due[j].NextAttempt) {
+			return due[i].ID < due[j].ID
+		}
+		return due[i].NextAttempt.Before(due[j].NextAttempt)
+	})
+	if offset >= len(due) {
+		return nil, nil
+	}
+	due = due[offset:]
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	// callers get copies so they can't change our index behind our back
+	jobs := make([]*DeliveryJob, len(due))
+	for i, job := range due {
+		c := *job
+		jobs[i] = &c
+	}
+	return jobs, nil
+}
+
+// DeleteDelivery removes the job from queue/
+func (fs *FileStore) DeleteDelivery(id string) error {
+	if !safeName(id) {
+		return errors.New("Illegal characters in job id")
+	}
+	fs.queueMu.Lock()
+	defer fs.queueMu.Unlock()
+	err := os.Remove(fs.dir + slash + "queue" + slash + id + ".json")
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	if err == nil && fs.queue != nil {
+		delete(fs.queue, id)
+	}
+	return err
+}
+
+// SaveDeadLetter moves the job from queue/ to deadletters/
+func (fs *FileStore) SaveDeadLetter(job *DeliveryJob) error {
+	err := fs.writeJob("deadletters", job)
+	if err != nil {
+		return err
+	}
+	return fs.DeleteDelivery(job.ID)
+}
+
+// DeadLetters reads all the jobs in deadletters/
+func (fs *FileStore) DeadLetters() ([]*DeliveryJob, error) {
+	return fs.readJobs("deadletters")
+}
+
+// readJSON unmarshals the contents of filename into v and
+// returns ErrNotFound if the file doesn't exist
+func (fs *FileStore) readJSON(filename string, v interface{}) error {
+	byteValue, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	if err != nil {
+		log.Info("Error reading " + filename)
+		return err
+	}
+	return json.Unmarshal(byteValue, v)
+}
+
+// safeName makes sure our users can't read our hard drive
+func safeName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "./\\ ")
+}
@@ -1,11 +1,13 @@
 package activityserve
 
 import (
+	gocontext "context"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/gologme/log"
 	"github.com/gorilla/mux"
@@ -14,23 +16,83 @@ import (
 	"encoding/json"
 )
 
+// how long we wait for requests in progress to finish when shutting down
+var shutdownTimeout = 10 * time.Second
+
 // ServeSingleActor just simplifies the call from main so
 // that onboarding is as easy as possible
 func ServeSingleActor(actor Actor) {
 	Serve(map[string]Actor{actor.Name: actor})
 }
 
-// Serve starts an http server with all the required handlers
+// Serve starts an http server on the configured address (:8081 by
+// default) with all the required handlers and exits if it fails
 func Serve(actors map[string]Actor) {
+	log.Fatal(ListenAndServe(gocontext.Background(), defaultInstance.listenAddress, actors))
+}
+
+// ListenAndServe serves the actors of the default instance on addr
+// until ctx is cancelled
+func ListenAndServe(ctx gocontext.Context, addr string, actors map[string]Actor) error {
+	return defaultInstance.ListenAndServe(ctx, addr, actors)
+}
+
+// ListenAndServe serves the actors on addr until ctx is cancelled, at which
+// point it stops accepting new connections and waits for the requests in
+// progress to finish before returning
+func (i *Instance) ListenAndServe(ctx gocontext.Context, addr string, actors map[string]Actor) error {
+	server := &http.Server{Addr: addr, Handler: i.NewHandler(actors)}
+
+	// make sure the goroutine below ends even if we fail to listen
+	ctx, cancel := gocontext.WithCancel(ctx)
+	defer cancel()
+
+	shutdownErr := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := gocontext.WithTimeout(gocontext.Background(), shutdownTimeout)
+		defer cancel()
+		shutdownErr <- server.Shutdown(shutdownCtx)
+	}()
+
+	err := server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	return <-shutdownErr
+}
+
+// NewHandler returns a handler for the actors of the default instance
+func NewHandler(actors map[string]Actor) http.Handler {
+	return defaultInstance.NewHandler(actors)
+}
+
+// NewHandler returns a handler with all the routes needed to serve the
+// actors, to be mounted at the root of the base url of the instance in
+// any http server. Instances on different domains can be served by the
+// same server by picking the handler according to the Host header
+func (i *Instance) NewHandler(actors map[string]Actor) http.Handler {
+	// pick up any deliveries left in the queue by a previous run
+	i.startDeliveries()
+
+	// getActor returns the actor we serve with that name so that we share
+	// its state and callbacks with the application, loading it from
+	// storage if it's not one of them
+	getActor := func(name string) (Actor, error) {
+		if actor, ok := actors[name]; ok {
+			return actor, nil
+		}
+		return i.LoadActor(name)
+	}
 
 	var webfingerHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/jrd+json; charset=utf-8")
 		account := r.URL.Query().Get("resource")              // should be something like acct:user@example.com
 		account = strings.Replace(account, "acct:", "", 1)    // remove acct:
-		server := strings.Split(baseURL, "://")[1]            // remove protocol from baseURL. Should get example.com
+		server := strings.Split(i.baseURL, "://")[1]          // remove protocol from baseURL. Should get example.com
 		server = strings.TrimSuffix(server, "/")              // remove protocol from baseURL. Should get example.com
 		account = strings.Replace(account, "@"+server, "", 1) // remove server from handle. Should get user
-		actor, err := LoadActor(account)
+		actor, err := i.LoadActor(account)
 		// error out if this actor does not exist
 		if err != nil {
 			log.Info("No such actor")
@@ -48,7 +110,7 @@ func Serve(actors map[string]Actor) {
 		link1 := make(map[string]string)
 		link1["rel"] = "self"
 		link1["type"] = "application/activity+json"
-		link1["href"] = baseURL + actor.Name
+		link1["href"] = i.baseURL + actor.Name
 		links[0] = link1
 		responseMap["links"] = links
 
@@ -69,7 +131,7 @@ func Serve(actors map[string]Actor) {
 			log.Info("well-known, skipping...")
 			return
 		}
-		actor, err := LoadActor(username)
+		actor, err := i.LoadActor(username)
 		// error out if this actor does not exist (or there are dots or slashes in his name)
 		if err != nil {
 			w.WriteHeader(http.StatusNotFound)
@@ -80,18 +142,18 @@ func Serve(actors map[string]Actor) {
 		fmt.Fprintf(w, actor.whoAmI())
 
 		// Show some debugging information
-		printer.Info("")
+		i.printer.Info("")
 		body, _ := ioutil.ReadAll(r.Body)
 		PrettyPrintJSON(body)
 		log.Info(FormatHeaders(r.Header))
-		printer.Info("")
+		i.printer.Info("")
 	}
 
 	var outboxHandler http.HandlerFunc = func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("content-type", "application/activity+json; charset=utf-8")
 		pageStr := r.URL.Query().Get("page") // get the page from the query string as string
 		username := mux.Vars(r)["actor"]     // get the needed actor from the muxer (url variable {actor} below)
-		actor, err := LoadActor(username)    // load the actor from disk
+		actor, err := i.LoadActor(username)  // load the actor from disk
 		if err != nil {                      // either actor requested has illegal characters or
 			log.Info("Can't load local actor") // we don't have such actor
 			fmt.Fprintf(w, "404 - page not found")
@@ -100,10 +162,9 @@ func Serve(actors map[string]Actor) {
 		}
 		postsPerPage := 100
 		var response []byte
-		filename := storage + slash + "actors" + slash + actor.Name + slash + "outbox.txt"
-		totalLines, err := lineCounter(filename)
+		totalLines, err := i.store.OutboxCount(actor.Name)
 		if err != nil {
-			log.Info("Can't read outbox.txt")
+			log.Info("Can't read the outbox")
 			log.Error(err)
 			return
 		}
@@ -111,38 +172,43 @@ func Serve(actors map[string]Actor) {
 			//TODO fix total items
 			response = []byte(`{
 				"@context" : "https://www.w3.org/ns/activitystreams",
-				"first" : "` + baseURL + actor.Name + `/outbox?page=1",
-				"id" : "` + baseURL + actor.Name + `/outbox",
-				"last" : "` + baseURL + actor.Name + `/outbox?page=` + strconv.Itoa(totalLines/postsPerPage+1) + `",
+				"first" : "` + i.baseURL + actor.Name + `/outbox?page=1",
+				"id" : "` + i.baseURL + actor.Name + `/outbox",
+				"last" : "` + i.baseURL + actor.Name + `/outbox?page=` + strconv.Itoa(totalLines/postsPerPage+1) + `",
 				"totalItems" : ` + strconv.Itoa(totalLines) + `, 
 				"type" : "OrderedCollection"
 			 }`)
 		} else {
 			page, err := strconv.Atoi(pageStr) // get page number from query string
-			if err != nil {
+			if err != nil || page < 1 {
 				log.Info("Page number not a number, assuming 1")
 				page = 1
 			}
-			lines, err := ReadLines(filename, (page-1)*postsPerPage, page*(postsPerPage+1)-1)
+			lines, err := i.store.Outbox(actor.Name, (page-1)*postsPerPage, postsPerPage)
 			if err != nil {
-				log.Info("Can't read outbox file")
+				log.Info("Can't read the outbox")
 				log.Error(err)
 				return
 			}
-			responseMap := make(map[string]interface{})
-			responseMap["@context"] = context()
-			responseMap["id"] = baseURL + actor.Name + "/outbox?page=" + pageStr
+			collectionPage := &Collection{
+				Context:    context(),
+				ID:         i.baseURL + actor.Name + "/outbox?page=" + pageStr,
+				Type:       "OrderedCollectionPage",
+				TotalItems: totalLines,
+				PartOf:     NewIRI(i.baseURL + actor.Name + "/outbox"),
+			}
 
 			if page*postsPerPage < totalLines {
-				responseMap["next"] = baseURL + actor.Name + "/outbox?page=" + strconv.Itoa(page+1)
+				collectionPage.Next = NewIRI(i.baseURL + actor.Name + "/outbox?page=" + strconv.Itoa(page+1))
 			}
 			if page > 1 {
-				responseMap["prev"] = baseURL + actor.Name + "/outbox?page=" + strconv.Itoa(page-1)
+				collectionPage.Prev = NewIRI(i.baseURL + actor.Name + "/outbox?page=" + strconv.Itoa(page-1))
 			}
-			responseMap["partOf"] = baseURL + actor.Name + "/outbox"
-			responseMap["type"] = "OrderedCollectionPage"
 
-			orderedItems := make([]interface{}, 0, postsPerPage)
+			orderedItems := make([]*IRIOrObject, 0, postsPerPage)
+			// followers only posts are listed only for followers
+			// that sign their request
+			fetcher := i.signedFetcher(r)
 
 			for _, item := range lines {
 				// split the line
@@ -150,25 +216,29 @@ func Serve(actors map[string]Actor) {
 
 				// keep the hash
 				hash := parts[len(parts)-1]
-				// build the filename
-				filename := storage + slash + "actors" + slash + actor.Name + slash + "items" + slash + hash + ".json"
-				// open the file
-				activityJSON, err := ioutil.ReadFile(filename)
+				// load the activity from storage
+				temp, err := actor.loadItem(hash)
 				if err != nil {
 					log.Error("can't read activity")
-					log.Info(filename)
+					log.Info(hash)
 					return
 				}
-				var temp map[string]interface{}
-				// put it into a map
-				json.Unmarshal(activityJSON, &temp)
+				item, err := objectFromMap(temp)
+				if err != nil {
+					log.Error("can't parse activity")
+					log.Info(hash)
+					return
+				}
+				if !actor.mayRead(item, fetcher) {
+					continue
+				}
 				// append to orderedItems
-				orderedItems = append(orderedItems, temp)
+				orderedItems = append(orderedItems, Embed(item))
 			}
 
-			responseMap["orderedItems"] = orderedItems
+			collectionPage.OrderedItems = orderedItems
 
-			response, err = json.Marshal(responseMap)
+			response, err = json.Marshal(collectionPage)
 			if err != nil {
 				log.Info("can't marshal map to json")
 				log.Error(err)
@@ -183,27 +253,83 @@ func Serve(actors map[string]Actor) {
 		if err != nil {
 			panic(err)
 		}
-		activity := make(map[string]interface{})
-		err = json.Unmarshal(b, &activity)
+		activity := &Activity{}
+		err = json.Unmarshal(b, activity)
 		if err != nil {
 			log.Error("Probably this request didn't have (valid) JSON inside it")
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "400 - invalid activity")
+			return
+		}
+		// make sure the activity comes from who it says it does
+		_, err = i.verifyRequest(r, b, activity.Actor.ID())
+		if err != nil {
+			log.Info("Failed to verify the signature of an incoming activity")
+			log.Info(err)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintf(w, "401 - signature verification failed")
 			return
 		}
 		// TODO check if it's actually an activity
 
 		// check if case is going to be an issue
-		switch activity["type"] {
+		switch activity.Type {
 		case "Follow":
 			// load the object as actor
-			actor, err := LoadActor(mux.Vars(r)["actor"]) // load the actor from disk
+			actor, err := getActor(mux.Vars(r)["actor"])
+			if err != nil {
+				log.Error("No such actor")
+				return
+			}
+			if actor.MovedTo() != "" {
+				log.Info(actor.Name + " has moved, rejecting the follow")
+				err = actor.reject(activity)
+				if err != nil {
+					log.Info(err)
+				}
+			} else if actor.ManuallyApprovesFollowers() {
+				// keep it until the application decides what to do
+				err = actor.addPendingFollower(activity)
+				if err != nil {
+					log.Info("Couldn't store the follow request")
+					log.Info(err)
+					return
+				}
+				actor.OnFollowRequest(activity)
+			} else {
+				actor.OnFollow(activity)
+			}
+		case "Undo":
+			actor, err := getActor(mux.Vars(r)["actor"])
+			if err != nil {
+				log.Error("No such actor")
+				return
+			}
+			actor.handleUndo(activity)
+		case "Delete":
+			actor, err := getActor(mux.Vars(r)["actor"])
 			if err != nil {
 				log.Error("No such actor")
 				return
 			}
-			actor.OnFollow(activity)
+			actor.handleDelete(activity, getActor)
+		case "Update":
+			actor, err := getActor(mux.Vars(r)["actor"])
+			if err != nil {
+				log.Error("No such actor")
+				return
+			}
+			actor.handleUpdate(activity, getActor)
+		case "Move":
+			actor, err := getActor(mux.Vars(r)["actor"])
+			if err != nil {
+				log.Error("No such actor")
+				return
+			}
+			actor.handleMove(activity)
 		case "Accept":
-			acceptor := activity["actor"].(string)
-			actor, err := LoadActor(mux.Vars(r)["actor"]) // load the actor from disk
+			acceptor := activity.Actor.ID()
+			actor, err := getActor(mux.Vars(r)["actor"])
 			if err != nil {
 				log.Error("No such actor")
 				return
@@ -211,16 +337,16 @@ func Serve(actors map[string]Actor) {
 
 			// From here down this could be moved to Actor (TBD)
 
-			follow := activity["object"].(map[string]interface{})
-			id := follow["id"].(string)
-
+			id := activity.Object.ID()
+			follow := activity.Object.Object
+			// some servers only send the id of the follow, otherwise
 			// check if the object of the follow is us
-			if follow["actor"].(string) != baseURL+actor.Name {
+			if follow != nil && follow.Actor.ID() != i.baseURL+actor.Name {
 				log.Info("This is not for us, ignoring")
 				return
 			}
 			// try to get the hash only
-			hash := strings.Replace(id, baseURL+actor.Name+"/item/", "", 1)
+			hash := strings.Replace(id, i.baseURL+actor.Name+"/item/", "", 1)
 			// if there are still slashes in the result this means the
 			// above didn't work
 			if strings.ContainsAny(hash, "/") {
@@ -240,7 +366,10 @@ func Serve(actors map[string]Actor) {
 
 			// pixelfed doesn't return the original follow thus the id is wrong so we
 			// need to just check if we requested this actor
-			if _, ok := actor.requested[acceptor]; !ok {
+			actor.mu.Lock()
+			_, requested := actor.requested[acceptor]
+			actor.mu.Unlock()
+			if !requested {
 				log.Info("We never requested this follow from " + acceptor + ", ignoring the Accept")
 				return
 			}
@@ -251,20 +380,24 @@ func Serve(actors map[string]Actor) {
 			// 	log.Info("Id mismatch between Follow request and Accept")
 			// 	return
 			// }
-			actor.following[acceptor] = hash
 			PrettyPrint(activity)
+			actor.mu.Lock()
+			actor.following[acceptor] = hash
 			delete(actor.requested, acceptor)
+			actor.mu.Unlock()
 			actor.save()
 		case "Reject":
-			rejector := activity["actor"].(string)
-			actor, err := LoadActor(mux.Vars(r)["actor"]) // load the actor from disk
+			rejector := activity.Actor.ID()
+			actor, err := getActor(mux.Vars(r)["actor"])
 			if err != nil {
 				log.Error("No such actor")
 				return
 			}
 			// write the actor to the list of rejected follows so that
 			// we won't try following them again
+			actor.mu.Lock()
 			actor.rejected[rejector] = ""
+			actor.mu.Unlock()
 			actor.save()
 		case "Create":
 			actor, ok := actors[mux.Vars(r)["actor"]] // load the actor from memory
@@ -274,6 +407,9 @@ func Serve(actors map[string]Actor) {
 			}
 			log.Info("Received the following activity from: " + r.UserAgent())
 			PrettyPrintJSON(b)
+			if actor.handleVote(activity) {
+				return
+			}
 			actor.OnReceiveContent(activity)
 		default:
 
@@ -289,7 +425,7 @@ func Serve(actors map[string]Actor) {
 			w.Write([]byte("404 - No such collection"))
 			return
 		}
-		actor, err := LoadActor(username)
+		actor, err := i.LoadActor(username)
 		// error out if this actor does not exist
 		if err != nil {
 			log.Errorf("Can't create local actor: %s", err)
@@ -313,29 +449,55 @@ func Serve(actors map[string]Actor) {
 		w.Header().Set("content-type", "application/activity+json; charset=utf-8")
 		username := mux.Vars(r)["actor"]
 		hash := mux.Vars(r)["hash"]
-		actor, err := LoadActor(username)
+		actor, err := i.LoadActor(username)
 		// error out if this actor does not exist
 		if err != nil {
 			log.Errorf("Can't create local actor: %s", err)
 			return
 		}
 		post, err := actor.loadItem(hash)
-		if err != nil {
+		// hashes with an underscore are our own bookkeeping (e.g. the
+		// votes of polls), not items
+		if err != nil || strings.Contains(hash, "_") {
 			w.WriteHeader(http.StatusNotFound)
 			fmt.Fprintf(w, "404 - post not found")
 			return
 		}
+		item, err := objectFromMap(post)
+		if err != nil {
+			log.Errorf("failed to parse item %s", hash)
+			return
+		}
+		// anything that's not public needs a signed request
+		// from somebody who's allowed to see it
+		if !isPublic(item) {
+			fetcher := i.signedFetcher(r)
+			if fetcher == "" {
+				w.WriteHeader(http.StatusUnauthorized)
+				fmt.Fprintf(w, "401 - signature required")
+				return
+			}
+			if !actor.mayRead(item, fetcher) {
+				w.WriteHeader(http.StatusForbidden)
+				fmt.Fprintf(w, "403 - forbidden")
+				return
+			}
+		}
 		postJSON, err := json.Marshal(post)
 		if err != nil {
 			log.Errorf("failed to marshal json from item %s text", hash)
 			return
 		}
+		// deleted posts leave a tombstone behind
+		if post["type"] == "Tombstone" {
+			w.WriteHeader(http.StatusGone)
+		}
 		w.Write(postJSON)
 	}
 
 	// Add the handlers to a HTTP server
 	gorilla := mux.NewRouter()
-	niCfg := nodeInfoConfig(baseURL)
+	niCfg := nodeInfoConfig(i.baseURL)
 	ni := nodeinfo.NewService(*niCfg, nodeInfoResolver{len(actors)})
 	gorilla.HandleFunc(nodeinfo.NodeInfoPath, http.HandlerFunc(ni.NodeInfoDiscover))
 	gorilla.HandleFunc(niCfg.InfoURL, http.HandlerFunc(ni.NodeInfo))
@@ -348,7 +510,7 @@ func Serve(actors map[string]Actor) {
 	gorilla.HandleFunc("/{actor}/", actorHandler)
 	gorilla.HandleFunc("/{actor}", actorHandler)
 	gorilla.HandleFunc("/{actor}/item/{hash}", postHandler)
-	http.Handle("/", gorilla)
+	gorilla.HandleFunc("/{actor}/media/{file}", i.mediaHandler)
 
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	return gorilla
 }
@@ -0,0 +1,192 @@
+package activityserve
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+)
+
+// Instance is a server hosting local actors under one domain. It owns the
+// configuration, the storage, the http client and the logger that the
+// actors living on it use, so that one process can host several domains
+// by creating an Instance for each of them.
+//
+// The package level functions (MakeActor, LoadActor, Serve etc.) act on a
+// default instance that is configured by Setup.
+type Instance struct {
+	baseURL       string
+	userAgent     string
+	listenAddress string
+	store         Store
+	// mediaDir is where the files uploaded by the actors are kept
+	mediaDir string
+	client   *http.Client
+	// printer is for debug output, it has no prefixes to be easier to read
+	printer *log.Logger
+
+	// maxClockSkew is how far the Date header of an incoming request can be
+	// from our own clock before we reject it
+	maxClockSkew time.Duration
+
+	// whether we follow the remote actors we follow to their new account
+	// when they move
+	followMoves bool
+
+	// the page hashtags link to, with the tag appended
+	tagsURL string
+
+	// how long we keep retrying a delivery before giving up
+	deliveryMaxAge time.Duration
+	// the delay before the first retry, doubled on each subsequent one
+	deliveryRetryDelay time.Duration
+	// the longest we wait between two attempts
+	deliveryMaxRetryDelay time.Duration
+	// how often we check the queue for jobs that are due
+	deliveryPollInterval time.Duration
+	// how many deliveries can be in progress at the same time
+	deliveryWorkers int
+	// how many deliveries to the same host can be in progress at the
+	// same time, so that one slow server can't take all the workers
+	deliveryPerHost int
+
+	deliveries *deliveryPool
+
+	// polls makes sure votes arriving together are all counted
+	polls sync.Mutex
+	// the polls with new results waiting to be sent, guarded by polls
+	pollUpdates map[string]bool
+	// how long we wait for more votes before sending the new results
+	pollUpdateDelay time.Duration
+
+	// the state of the actors that have been made or loaded, by name,
+	// shared by all the copies of each actor
+	actors   map[string]*actorState
+	actorsMu sync.Mutex
+	// the keys the actors sign their requests with, by name, so that
+	// the deliveries don't have to load the whole actor. Guarded by
+	// actorsMu too
+	signingKeys map[string]signingKey
+}
+
+// NewInstance returns an instance serving actors under baseURL
+// (e.g. https://example.com/) and keeping them in store, with the
+// default settings
+func NewInstance(baseURL string, store Store) *Instance {
+	config := DefaultConfig()
+	config.BaseURL = baseURL
+	return newInstance(config, store)
+}
+
+// NewInstanceFromConfig validates the configuration and returns an
+// instance set up according to it
+func NewInstanceFromConfig(config Config) (*Instance, error) {
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	store, err := config.openStore()
+	if err != nil {
+		return nil, err
+	}
+	return newInstance(config, store), nil
+}
+
+func newInstance(config Config, store Store) *Instance {
+	baseURL := config.BaseURL
+	// check if it ends with a / and append one if not
+	if !strings.HasSuffix(baseURL, "/") {
+		baseURL += "/"
+	}
+	i := &Instance{
+		baseURL:       baseURL,
+		userAgent:     config.UserAgent,
+		listenAddress: config.ListenAddress,
+		store:         store,
+		mediaDir:      filepath.Join(config.Storage, "media"),
+		// the client for all our requests to other servers. A slow server
+		// shouldn't be able to hold on to our requests forever
+		client:                &http.Client{Timeout: config.RequestTimeout},
+		printer:               log.New(os.Stdout, " ", 0),
+		maxClockSkew:          config.MaxClockSkew,
+		followMoves:           config.FollowMoves,
+		tagsURL:               config.TagsURL,
+		deliveryMaxAge:        config.Delivery.MaxAge,
+		deliveryRetryDelay:    config.Delivery.RetryDelay,
+		deliveryMaxRetryDelay: config.Delivery.MaxRetryDelay,
+		deliveryPollInterval:  10 * time.Second,
+		deliveryWorkers:       config.Delivery.Workers,
+		deliveryPerHost:       config.Delivery.PerHost,
+		deliveries:            newDeliveryPool(),
+		pollUpdates:           make(map[string]bool),
+		pollUpdateDelay:       10 * time.Second,
+		actors:                make(map[string]*actorState),
+		signingKeys:           make(map[string]signingKey),
+	}
+	if config.Debug {
+		i.printer.EnableLevel("info")
+	}
+	return i
+}
+
+// actorState returns the state shared by the copies of the actor called
+// name, which is state if the actor wasn't loaded yet or replace is set
+func (i *Instance) actorState(name string, state *actorState, replace bool) *actorState {
+	i.actorsMu.Lock()
+	defer i.actorsMu.Unlock()
+	if existing, ok := i.actors[name]; ok && !replace {
+		return existing
+	}
+	i.actors[name] = state
+	return state
+}
+
+// the instance the package level functions act on
+var defaultInstance = NewInstance("http://example.com/", &FileStore{dir: "storage"})
+
+// BaseURL returns the url the actors of the instance live under
+func (i *Instance) BaseURL() string {
+	return i.baseURL
+}
+
+// SetStore replaces the storage backend of the instance. It should be
+// called before any actor is created or loaded
+func (i *Instance) SetStore(s Store) {
+	i.store = s
+}
+
+// SetMediaDir sets the directory the files uploaded by the actors are kept in
+func (i *Instance) SetMediaDir(dir string) {
+	i.mediaDir = dir
+}
+
+// SetClient sets the http client used for all the requests to other servers
+func (i *Instance) SetClient(c *http.Client) {
+	i.client = c
+}
+
+// SetUserAgent sets the User-Agent we send to other servers
+func (i *Instance) SetUserAgent(userAgent string) {
+	i.userAgent = userAgent
+}
+
+// SetFollowMoves sets whether local actors follow the remote actors they
+// follow to their new account when these move
+func (i *Instance) SetFollowMoves(follow bool) {
+	i.followMoves = follow
+}
+
+// SetTagsURL sets the page hashtags link to, the tag is appended to it
+// (e.g. https://example.com/tags/). Without it hashtags are not linked
+func (i *Instance) SetTagsURL(tagsURL string) {
+	i.tagsURL = tagsURL
+}
+
+// SetLogger sets the logger used for debug output
+func (i *Instance) SetLogger(printer *log.Logger) {
+	i.printer = printer
+}
@@ -0,0 +1,125 @@
+package activityserve
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dchest/uniuri"
+	"github.com/gologme/log"
+	"github.com/gorilla/mux"
+)
+
+// Attachment is a file attached to a post, an Image or a Document with
+// its mediaType, url, name (the alt text) and for images the width,
+// height and blurhash
+type Attachment = Object
+
+// the types of files we store and the extensions we give them, mime
+// picks odd ones (e.g. .jfif for jpegs). Anything else (html, svg etc.)
+// could run scripts on our domain so it's not accepted
+var mediaExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+	"video/mp4":  ".mp4",
+	"audio/mpeg": ".mp3",
+}
+
+// UploadMedia stores a file of the actor to attach it to notes through
+// NoteOptions.Attachments. name is the description (alt text) of the file.
+// Only images, mp4 videos and mp3 audio are accepted. The Width, Height and
+// Blurhash of the attachment that comes back can be filled in before
+// attaching it
+func (a *Actor) UploadMedia(data io.Reader, mediaType, name string) (*Attachment, error) {
+	mediaType, _, err := mime.ParseMediaType(mediaType)
+	if err != nil {
+		return nil, errors.New("invalid media type: " + err.Error())
+	}
+	ext, ok := mediaExtensions[mediaType]
+	if !ok {
+		return nil, errors.New("unsupported media type: " + mediaType)
+	}
+
+	dir := filepath.Join(a.instance.mediaDir, a.Name)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		log.Info("Could not create the media directory")
+		return nil, err
+	}
+	filename := uniuri.New() + ext
+	file, err := os.Create(filepath.Join(dir, filename))
+	if err != nil {
+		log.Info("Could not create media file")
+		return nil, err
+	}
+	_, err = io.Copy(file, data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Info("Could not write media file")
+		os.Remove(filepath.Join(dir, filename))
+		return nil, err
+	}
+
+	attachmentType := "Document"
+	if strings.HasPrefix(mediaType, "image/") {
+		attachmentType = "Image"
+	}
+	return &Attachment{
+		Type:      attachmentType,
+		MediaType: mediaType,
+		URL:       Strings{a.instance.baseURL + a.Name + "/media/" + filename},
+		Name:      name,
+	}, nil
+}
+
+// storedMediaType returns the type of a stored file by its extension. Files
+// of other types are served as downloads
+func storedMediaType(filename string) string {
+	ext := filepath.Ext(filename)
+	for mediaType, known := range mediaExtensions {
+		if ext == known {
+			return mediaType
+		}
+	}
+	return "application/octet-stream"
+}
+
+// mediaHandler serves the files uploaded by the actors with the type
+// we stored them as, browsers must not guess it from the content
+func (i *Instance) mediaHandler(w http.ResponseWriter, r *http.Request) {
+	username := mux.Vars(r)["actor"]
+	file := mux.Vars(r)["file"]
+	// stay inside the media directory
+	for _, part := range []string{username, file} {
+		if part == "" || strings.HasPrefix(part, ".") || strings.ContainsAny(part, `/\`) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	}
+	f, err := os.Open(filepath.Join(i.mediaDir, username, file))
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	contentType := storedMediaType(file)
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	if contentType == "application/octet-stream" {
+		w.Header().Set("Content-Disposition", "attachment")
+	}
+	http.ServeContent(w, r, file, info.ModTime(), f)
+}
@@ -0,0 +1,54 @@
+package activityserve
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMedia(t *testing.T) {
+	i := newTestInstance(t)
+	i.SetMediaDir(t.TempDir())
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = actor.UploadMedia(strings.NewReader("<script>alert(1)</script>"), "text/html", "")
+	if err == nil {
+		t.Fatal("html was accepted as media")
+	}
+	attachment, err := actor.UploadMedia(strings.NewReader("<script>alert(1)</script>"), "image/png", "not a png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a file of a type we don't accept any more
+	err = os.WriteFile(filepath.Join(i.mediaDir, "alice", "old.html"), []byte("<script>alert(1)</script>"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := i.NewHandler(nil)
+	tests := []struct {
+		url         string
+		contentType string
+	}{
+		{attachment.URL[0], "image/png"},
+		{"https://local.example/alice/media/old.html", "application/octet-stream"},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", test.url, nil))
+		if w.Code != 200 {
+			t.Fatalf("%s: got status %d", test.url, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("%s: served as %s, want %s", test.url, got, test.contentType)
+		}
+		if w.Header().Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: browsers may sniff the type", test.url)
+		}
+	}
+}
@@ -0,0 +1,250 @@
+package activityserve
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gologme/log"
+)
+
+// Question is a poll, its choices are Notes in oneOf (pick one) or anyOf
+// (pick any) whose replies count the votes
+type Question = Object
+
+// CreateQuestion posts a poll with content as the question and returns
+// its id. Voters can pick one of the choices, or any number of them if
+// multiple is set, until the poll closes at endTime
+func (a *Actor) CreateQuestion(content string, choices []string, multiple bool, endTime time.Time, options NoteOptions) (string, error) {
+	if len(choices) < 2 {
+		return "", errors.New("a poll needs at least two choices")
+	}
+	question := &Question{
+		Type:    "Question",
+		Content: content,
+		EndTime: endTime.UTC().Format(time.RFC3339),
+	}
+	seen := make(map[string]bool)
+	for _, choice := range choices {
+		if choice == "" || seen[choice] {
+			return "", errors.New("the choices of a poll should be distinct and not empty")
+		}
+		seen[choice] = true
+		option := &Object{Type: "Note", Name: choice, Replies: &Collection{Type: "Collection"}}
+		if multiple {
+			question.AnyOf = append(question.AnyOf, option)
+		} else {
+			question.OneOf = append(question.OneOf, option)
+		}
+	}
+	id, err := a.publish(question, options)
+	if err != nil {
+		return "", err
+	}
+	a.closePollAt(id, endTime)
+	return id, nil
+}
+
+// closePollAt closes the poll at endTime. The timer doesn't survive a
+// restart, in which case polls close on the first vote after endTime or
+// with ClosePoll
+func (a *Actor) closePollAt(id string, endTime time.Time) {
+	time.AfterFunc(time.Until(endTime), func() {
+		err := a.ClosePoll(id)
+		if err != nil {
+			log.Info("Could not close poll " + id)
+			log.Info(err)
+		}
+	})
+}
+
+// ClosePoll closes one of our polls, if it's not closed already, and sends
+// the final results to everybody who got it and to the voters
+func (a *Actor) ClosePoll(id string) error {
+	a.instance.polls.Lock()
+	hash, create, err := a.loadQuestion(id)
+	if err != nil {
+		a.instance.polls.Unlock()
+		return err
+	}
+	question := create.Object.Object
+	if question.Closed != nil {
+		a.instance.polls.Unlock()
+		return nil
+	}
+	question.Closed = time.Now().UTC().Format(time.RFC3339)
+	err = a.saveItem(hash, create)
+	a.instance.polls.Unlock()
+	if err != nil {
+		log.Info("Could not save poll to storage")
+		return err
+	}
+	return a.sendPollUpdate(hash, question)
+}
+
+// loadQuestion loads the Create activity of one of our polls
+func (a *Actor) loadQuestion(id string) (string, *Activity, error) {
+	hash, create, err := a.loadPost(id)
+	if err != nil {
+		return "", nil, err
+	}
+	if create.Object.Object.Type != "Question" {
+		return "", nil, errors.New(id + " is not a poll")
+	}
+	return hash, create, nil
+}
+
+// votesHash is the hash the voters of a poll are stored under. Hashes
+// with an underscore are not served, so nobody gets to see who voted
+// for what
+func votesHash(hash string) string {
+	return hash + "_votes"
+}
+
+// loadVotes returns the choices of each voter of a poll
+func (a *Actor) loadVotes(hash string) (map[string][]string, error) {
+	votes := make(map[string][]string)
+	item, err := a.instance.store.LoadItem(a.Name, votesHash(hash))
+	if err == ErrNotFound {
+		return votes, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for voter, choices := range item {
+		votes[voter] = []string(stringsOf(choices))
+	}
+	return votes, nil
+}
+
+// handleVote counts a vote on one of our polls. Votes are Creates of a
+// Note with the name of a choice in reply to the poll, one per choice. It
+// tells whether the activity was a vote, in which case it's not content
+func (a *Actor) handleVote(activity *Activity) bool {
+	if activity.Object == nil || activity.Object.Object == nil {
+		return false
+	}
+	vote := activity.Object.Object
+	if vote.Name == "" || !strings.HasPrefix(vote.InReplyTo.ID(), a.iri+"/item/") {
+		return false
+	}
+
+	a.instance.polls.Lock()
+	hash, create, err := a.loadQuestion(vote.InReplyTo.ID())
+	if err != nil {
+		a.instance.polls.Unlock()
+		return false
+	}
+	question := create.Object.Object
+	counted, err := a.countVote(hash, question, activity.Actor.ID(), vote)
+	if err == nil && counted {
+		err = a.saveItem(hash, create)
+	}
+	a.instance.polls.Unlock()
+	if err != nil {
+		log.Info("Could not count vote on " + question.ID)
+		log.Info(err)
+		return true
+	}
+	if counted {
+		a.schedulePollUpdate(question.ID)
+	}
+	return true
+}
+
+// schedulePollUpdate sends the new results of a poll a little later, in
+// the background, so that a busy poll sends one update for a bunch of
+// votes instead of one for each of them
+func (a *Actor) schedulePollUpdate(id string) {
+	a.instance.polls.Lock()
+	defer a.instance.polls.Unlock()
+	if a.instance.pollUpdates[id] {
+		// the update that's coming has this vote too
+		return
+	}
+	a.instance.pollUpdates[id] = true
+	time.AfterFunc(a.instance.pollUpdateDelay, func() {
+		a.instance.polls.Lock()
+		delete(a.instance.pollUpdates, id)
+		hash, create, err := a.loadQuestion(id)
+		a.instance.polls.Unlock()
+		if err == nil {
+			err = a.sendPollUpdate(hash, create.Object.Object)
+		}
+		if err != nil {
+			log.Info("Could not send the new results of " + id)
+			log.Info(err)
+		}
+	})
+}
+
+// countVote adds the vote to the tally of the question. Votes on closed
+// polls, for choices that don't exist or that the voter already made are
+// not counted. It tells whether the vote was counted
+func (a *Actor) countVote(hash string, question *Question, voter string, vote *Object) (bool, error) {
+	if voter == "" || (len(vote.AttributedTo) > 0 && !vote.AttributedTo.Contains(voter)) {
+		log.Info("Ignoring a vote on behalf of somebody else")
+		return false, nil
+	}
+	if question.Closed != nil {
+		log.Info("Ignoring a vote on a closed poll")
+		return false, nil
+	}
+	if endTime, err := time.Parse(time.RFC3339, question.EndTime); err == nil && time.Now().After(endTime) {
+		log.Info("Ignoring a vote after the end of the poll")
+		// the timer must have been lost to a restart
+		go a.ClosePoll(question.ID)
+		return false, nil
+	}
+
+	options, multiple := question.OneOf, false
+	if len(question.AnyOf) > 0 {
+		options, multiple = question.AnyOf, true
+	}
+	var choice *Object
+	for _, option := range options {
+		if option.Name == vote.Name {
+			choice = option
+		}
+	}
+	if choice == nil {
+		log.Info("Ignoring a vote for " + vote.Name + " which is not a choice")
+		return false, nil
+	}
+
+	votes, err := a.loadVotes(hash)
+	if err != nil {
+		return false, err
+	}
+	previous := votes[voter]
+	if containsString(previous, choice.Name) || (!multiple && len(previous) > 0) {
+		log.Info(voter + " already voted")
+		return false, nil
+	}
+	votes[voter] = append(previous, choice.Name)
+	err = a.saveItem(votesHash(hash), votes)
+	if err != nil {
+		return false, err
+	}
+
+	if choice.Replies == nil {
+		choice.Replies = &Collection{Type: "Collection"}
+	}
+	choice.Replies.TotalItems++
+	question.VotersCount = len(votes)
+	return true, nil
+}
+
+// sendPollUpdate sends the current results of a poll to the ones that got
+// it and to the voters
+func (a *Actor) sendPollUpdate(hash string, question *Question) error {
+	votes, err := a.loadVotes(hash)
+	if err != nil {
+		return err
+	}
+	voters := make([]string, 0, len(votes))
+	for voter := range votes {
+		voters = append(voters, voter)
+	}
+	return a.sendToAudience(a.newUpdate(question), question, voters)
+}
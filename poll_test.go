@@ -0,0 +1,71 @@
+package activityserve
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestVotesAreSentTogether(t *testing.T) {
+	base, received := inboxServer(t)
+	i := newDeliveringInstance(t)
+	i.pollUpdateDelay = 200 * time.Millisecond
+	actor, err := i.MakeActor("alice", "", "Person")
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := actor.CreateQuestion("cats or dogs?", []string{"cats", "dogs"}, false, time.Now().Add(time.Hour), NoteOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const voters = 10
+	for n := 0; n < voters; n++ {
+		voter := fmt.Sprintf("%s/users/%d", base, n)
+		vote := activityFrom(t, map[string]interface{}{
+			"type":  "Create",
+			"actor": voter,
+			"object": map[string]interface{}{
+				"type":         "Note",
+				"name":         "cats",
+				"attributedTo": voter,
+				"inReplyTo":    id,
+			},
+		})
+		if !actor.handleVote(vote) {
+			t.Fatal("the vote wasn't taken as one")
+		}
+	}
+
+	_, create, err := actor.loadQuestion(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := create.Object.Object.VotersCount; got != voters {
+		t.Fatalf("counted %d voters, want %d", got, voters)
+	}
+
+	// one update with all the votes for each voter
+	updates := make(map[string]int)
+	timeout := time.After(5 * time.Second)
+	for len(updates) < voters {
+		select {
+		case delivery := <-received:
+			if delivery[1] == "Update" {
+				updates[delivery[0]]++
+			}
+		case <-timeout:
+			t.Fatalf("only %d voters got the results", len(updates))
+		}
+	}
+	select {
+	case delivery := <-received:
+		updates[delivery[0]]++
+	case <-time.After(2 * i.pollUpdateDelay):
+	}
+	for voter, n := range updates {
+		if n != 1 {
+			t.Errorf("%s got %d updates", voter, n)
+		}
+	}
+}
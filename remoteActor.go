@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/gologme/log"
 )
@@ -16,29 +17,50 @@ type RemoteActor struct {
 	iri, outbox, inbox, sharedInbox string
 	url                             string
 	info                            map[string]interface{}
+	instance                        *Instance
 }
 
 // NewRemoteActor returns a remoteActor which holds
 // all the info required for an actor we want to
 // interact with (not essentially sitting in our instance)
 func NewRemoteActor(iri string) (RemoteActor, error) {
-	info, err := get(iri)
+	return defaultInstance.NewRemoteActor(iri)
+}
+
+// NewRemoteActor returns a remoteActor fetched with the
+// client of the instance
+func (i *Instance) NewRemoteActor(iri string) (RemoteActor, error) {
+	info, err := i.get(iri)
 	if err != nil {
 		log.Info("Couldn't get remote actor information")
 		log.Error(err)
 		return RemoteActor{}, err
 	}
+	return i.remoteActorFromInfo(iri, info), nil
+}
 
+// cachedRemoteActor returns a remote actor from our cache of foreign
+// objects, fetching it only if we don't have it. Updates of the actor
+// keep the cache fresh
+func (i *Instance) cachedRemoteActor(iri string) (RemoteActor, error) {
+	info, err := i.getCached(iri, false)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	return i.remoteActorFromInfo(iri, info), nil
+}
+
+// remoteActorFromInfo reads the properties we care about from
+// the json document of a remote actor
+func (i *Instance) remoteActorFromInfo(iri string, info map[string]interface{}) RemoteActor {
 	outbox, _ := info["outbox"].(string)
 	inbox, _ := info["inbox"].(string)
-	url, _ := info["url"].(string)
+	profile, _ := info["url"].(string)
 	var endpoints map[string]interface{}
 	var sharedInbox string
-	if info["endpoints"] != nil {
-		endpoints = info["endpoints"].(map[string]interface{})
-		if val, ok := endpoints["sharedInbox"]; ok {
-			sharedInbox = val.(string)
-		}
+	var ok bool
+	if endpoints, ok = info["endpoints"].(map[string]interface{}); ok {
+		sharedInbox, _ = endpoints["sharedInbox"].(string)
 	}
 
 	return RemoteActor{
@@ -46,15 +68,17 @@ func NewRemoteActor(iri string) (RemoteActor, error) {
 		outbox:      outbox,
 		inbox:       inbox,
 		sharedInbox: sharedInbox,
-		url:         url,
-	}, err
+		url:         profile,
+		info:        info,
+		instance:    i,
+	}
 }
 
 func (ra RemoteActor) getLatestPosts(number int) (map[string]interface{}, error) {
-	return get(ra.outbox)
+	return ra.instance.get(ra.outbox)
 }
 
-func get(iri string) (info map[string]interface{}, err error) {
+func (i *Instance) get(iri string) (info map[string]interface{}, err error) {
 	buf := new(bytes.Buffer)
 
 	req, err := http.NewRequest("GET", iri, buf)
@@ -63,15 +87,16 @@ func get(iri string) (info map[string]interface{}, err error) {
 		return
 	}
 	req.Header.Add("Accept", "application/activity+json")
-	req.Header.Add("User-Agent", userAgent+" "+version)
+	req.Header.Add("User-Agent", i.userAgent+" "+version)
 	req.Header.Add("Accept-Charset", "utf-8")
 
-	resp, err := client.Do(req)
+	resp, err := i.client.Do(req)
 	if err != nil {
 		log.Info("Cannot perform the request")
 		log.Error(err)
 		return
 	}
+	defer resp.Body.Close()
 
 	responseData, _ := ioutil.ReadAll(resp.Body)
 
@@ -89,11 +114,38 @@ func get(iri string) (info map[string]interface{}, err error) {
 		log.Error(err)
 		return
 	}
-	info = e.(map[string]interface{})
+	info, ok := e.(map[string]interface{})
+	if !ok {
+		err = fmt.Errorf("GET request to %s returned something that's not an object", iri)
+		log.Info(err)
+		return nil, err
+	}
 
 	return
 }
 
+// getCached returns the object at iri from our cache of foreign
+// objects, fetching and caching it if we don't have it or if refresh
+// is set
+func (i *Instance) getCached(iri string, refresh bool) (info map[string]interface{}, err error) {
+	if !refresh {
+		info, err = i.store.LoadForeign(iri)
+		if err == nil {
+			return info, nil
+		}
+	}
+	info, err = i.get(iri)
+	if err != nil {
+		return
+	}
+	err = i.store.SaveForeign(iri, info)
+	if err != nil {
+		log.Info("Couldn't cache " + iri)
+		log.Info(err)
+	}
+	return info, nil
+}
+
 // GetInbox returns the inbox url of the actor
 func (ra RemoteActor) GetInbox() string {
 	return ra.inbox
@@ -110,3 +162,14 @@ func (ra RemoteActor) GetSharedInbox() string {
 func (ra RemoteActor) URL() string {
 	return ra.url
 }
+
+// Handle returns the @user@host handle of the actor, or its
+// iri if it has no preferredUsername
+func (ra RemoteActor) Handle() string {
+	username, _ := ra.info["preferredUsername"].(string)
+	iri, err := url.Parse(ra.iri)
+	if username == "" || err != nil {
+		return ra.iri
+	}
+	return "@" + username + "@" + iri.Host
+}
@@ -0,0 +1,26 @@
+package activityserve
+
+import (
+	"testing"
+)
+
+func TestGetOnlyAcceptsObjects(t *testing.T) {
+	base := remoteServer(t, map[string]func(string) interface{}{
+		"/object": func(base string) interface{} { return map[string]interface{}{"id": base + "/object"} },
+		"/array":  func(string) interface{} { return []interface{}{"a", "b"} },
+		"/string": func(string) interface{} { return "hi" },
+		"/null":   func(string) interface{} { return nil },
+	})
+	i := newTestInstance(t)
+	for path, wantErr := range map[string]bool{
+		"/object": false,
+		"/array":  true,
+		"/string": true,
+		"/null":   true,
+	} {
+		info, err := i.get(base + path)
+		if (err != nil) != wantErr {
+			t.Errorf("%s: got %v, %v", path, info, err)
+		}
+	}
+}
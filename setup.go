@@ -2,7 +2,6 @@ package activityserve
 
 import (
 	"fmt"
-	"net/http"
 	"os"
 
 	"github.com/gologme/log"
@@ -10,75 +9,65 @@ import (
 )
 
 var slash = string(os.PathSeparator)
-var baseURL = "http://example.com/"
-var storage = "storage"
-var userAgent = "activityserve"
-var printer *log.Logger
 
 const libName = "activityserve"
 const version = "0.99"
 
-var client = http.Client{}
-
-// Setup sets our environment up
-func Setup(configurationFile string, debug bool) *ini.File {
-	// read configuration file (config.ini)
-
+// Setup sets the default instance up from configurationFile (config.ini
+// if empty), which can be INI or TOML, with any ACTIVITYSERVE_*
+// environment variables taking precedence. The INI file is returned so
+// that applications can keep their own settings in it, it's nil for TOML
+func Setup(configurationFile string, debug bool) (*ini.File, error) {
 	if configurationFile == "" {
 		configurationFile = "config.ini"
 	}
 
-	cfg, err := ini.Load("config.ini")
+	config, cfg, err := loadConfigFile(configurationFile)
+	if err != nil {
+		return nil, err
+	}
+	err = config.LoadEnv()
 	if err != nil {
-		fmt.Printf("Fail to read file: %v", err)
-		os.Exit(1)
+		return nil, err
 	}
+	config.Debug = config.Debug || debug
+
+	return cfg, SetupWithConfig(config)
+}
 
-	// Load base url from configuration file
-	baseURL = cfg.Section("general").Key("baseURL").String()
-	// check if it ends with a / and append one if not
-	if baseURL[len(baseURL)-1:] != "/" {
-		baseURL += "/"
+// SetupWithConfig sets the default instance up from a configuration
+// built in code
+func SetupWithConfig(config Config) error {
+	i, err := NewInstanceFromConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid configuration: %v", err)
 	}
+	defaultInstance = i
+
 	// print it for our users
 	fmt.Println()
-	fmt.Println("Domain Name:", baseURL)
-
-	// Load storage location (only local filesystem supported for now) from config
-	storage = cfg.Section("general").Key("storage").String()
-	cwd, err := os.Getwd()
-	fmt.Println("Storage Location:", cwd+slash+storage)
+	fmt.Println("Domain Name:", i.baseURL)
+	cwd, _ := os.Getwd()
+	fmt.Println("Storage Location:", cwd+slash+config.Storage)
 	fmt.Println()
 
-	SetupStorage(storage)
-
-	// Load user agent
-	userAgent = cfg.Section("general").Key("userAgent").String()
-
 	// I prefer long file so that I can click it in the terminal and open it
 	// in the editor above
 	log.SetFlags(log.Llongfile)
 	log.EnableLevel("warn")
-	// create a logger with levels but without prefixes for easier to read
-	// debug output
-	printer = log.New(os.Stdout, " ", 0)
 
-	if debug == true {
+	if config.Debug {
 		fmt.Println()
 		fmt.Println("debug mode on")
 		log.EnableLevel("info")
-		printer.EnableLevel("info")
 	}
 
-	return cfg
+	return nil
 }
 
-// SetupStorage creates storage
+// SetupStorage creates the default filesystem storage
+// in the directory `storage`, uploaded media go in `storage/media`
 func SetupStorage(storage string) {
-	// prepare storage for foreign activities (activities we store that don't
-	// belong to us)
-	foreignDir := storage + slash + "foreign"
-	if _, err := os.Stat(foreignDir); os.IsNotExist(err) {
-		os.MkdirAll(foreignDir, 0755)
-	}
+	defaultInstance.SetStore(NewFileStore(storage))
+	defaultInstance.SetMediaDir(storage + slash + "media")
 }
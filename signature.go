@@ -0,0 +1,299 @@
+package activityserve
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-fed/httpsig"
+	"github.com/gologme/log"
+)
+
+// the headers we require to be covered by the signature of an
+// incoming POST. These are the same ones we sign in signedHTTPPost
+var requiredSignedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// verifyRequest checks the date, digest and http signature of an incoming
+// request and makes sure that the owner of the key that signed it is the
+// actor of the activity. It returns the iri of the key owner
+func (i *Instance) verifyRequest(r *http.Request, body []byte, actor string) (string, error) {
+	err := i.verifyDate(r)
+	if err != nil {
+		return "", err
+	}
+	err = verifyDigest(r, body)
+	if err != nil {
+		return "", err
+	}
+	owner, err := i.verifySignature(r, requiredSignedHeaders)
+	if err != nil {
+		return "", err
+	}
+	if actor == "" {
+		return "", errors.New("activity has no actor")
+	}
+	if owner != actor {
+		return "", fmt.Errorf("key owner %s does not match activity actor %s", owner, actor)
+	}
+	return owner, nil
+}
+
+// verifySignature verifies the Signature header of a request against
+// the public key of the remote actor it claims to be signed with and
+// returns the iri of the owner of that key
+func (i *Instance) verifySignature(r *http.Request, required []string) (string, error) {
+	verifier, err := httpsig.NewVerifier(r)
+	if err != nil {
+		return "", err
+	}
+
+	// make sure all the headers we care about are signed
+	signed := signedHeaders(r)
+	for _, h := range required {
+		if !containsString(signed, h) {
+			return "", fmt.Errorf("header %s is not signed", h)
+		}
+	}
+
+	keyID := verifier.KeyId()
+	owner, publicKey, err := i.fetchPublicKey(keyID, false)
+	if err == nil {
+		err = verifier.Verify(publicKey, httpsig.RSA_SHA256)
+	}
+	if err != nil {
+		// the remote actor might have changed their key since we
+		// cached it, so fetch it again before giving up
+		owner, publicKey, err = i.fetchPublicKey(keyID, true)
+		if err != nil {
+			return "", err
+		}
+		err = verifier.Verify(publicKey, httpsig.RSA_SHA256)
+		if err != nil {
+			return "", err
+		}
+	}
+	return owner, nil
+}
+
+// signedHeaders returns the (lowercase) list of headers that the
+// signature of a request claims to cover
+func signedHeaders(r *http.Request) []string {
+	sig := r.Header.Get("Signature")
+	if sig == "" {
+		sig = strings.TrimPrefix(r.Header.Get("Authorization"), "Signature ")
+	}
+	for _, param := range strings.Split(sig, ",") {
+		param = strings.TrimSpace(param)
+		if !strings.HasPrefix(param, "headers=") {
+			continue
+		}
+		value := strings.Trim(strings.TrimPrefix(param, "headers="), "\"")
+		return strings.Fields(strings.ToLower(value))
+	}
+	// the spec says that if no headers are declared only the date
+	// header is signed
+	return []string{"date"}
+}
+
+// fetchPublicKey dereferences a keyId and returns the owner of the key
+// and the key itself. The keyId can point either to an actor that embeds
+// the key or to the key document itself, in which case the owner must
+// publish the same key. Unless refresh is set the cached copies are used
+// if we have them
+func (i *Instance) fetchPublicKey(keyID string, refresh bool) (owner string, key crypto.PublicKey, err error) {
+	info, err := i.getCached(keyID, refresh)
+	if err != nil {
+		log.Info("Couldn't fetch the key " + keyID)
+		return "", nil, err
+	}
+	// the document must be the one keyID points to, otherwise anybody
+	// could serve a copy of somebody else's actor with their own key in it
+	id, _ := info["id"].(string)
+	if id != keyID && id != withoutFragment(keyID) {
+		return "", nil, fmt.Errorf("%s serves %q instead of itself", keyID, id)
+	}
+
+	keyInfo := info
+	if _, ok := info["publicKeyPem"]; !ok {
+		keyInfo = findKey(info["publicKey"], keyID)
+		if keyInfo == nil {
+			return "", nil, errors.New("no public key found in " + keyID)
+		}
+		// the key is embedded in the actor so the owner is the actor
+		// unless the key says otherwise
+		owner = id
+	}
+	if o, ok := keyInfo["owner"].(string); ok {
+		if owner != "" && o != owner {
+			return "", nil, errors.New("key owner does not match the actor that embeds it")
+		}
+		owner = o
+	}
+	if owner == "" {
+		return "", nil, errors.New("cannot determine the owner of " + keyID)
+	}
+
+	pemString, _ := keyInfo["publicKeyPem"].(string)
+	// a standalone key can claim any owner, so the owner
+	// has to confirm that the key is theirs
+	if owner != id {
+		ownerInfo, err := i.getCached(owner, refresh)
+		if err != nil {
+			log.Info("Couldn't fetch the owner of the key " + keyID)
+			return "", nil, err
+		}
+		if ownerID, _ := ownerInfo["id"].(string); ownerID != owner {
+			return "", nil, fmt.Errorf("%s serves %q instead of itself", owner, ownerID)
+		}
+		published := findKey(ownerInfo["publicKey"], keyID)
+		if published == nil || published["id"] != keyID || published["publicKeyPem"] != pemString {
+			return "", nil, fmt.Errorf("%s does not publish the key %s", owner, keyID)
+		}
+	}
+
+	block, _ := pem.Decode([]byte(pemString))
+	if block == nil {
+		return "", nil, errors.New("failed to parse PEM block containing the public key")
+	}
+	key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		// some implementations still publish PKCS1 keys
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			log.Info("Can't parse public key " + keyID)
+			return "", nil, err
+		}
+	}
+	return owner, key, nil
+}
+
+// withoutFragment removes the #fragment from an iri
+func withoutFragment(iri string) string {
+	return strings.SplitN(iri, "#", 2)[0]
+}
+
+// findKey finds the key with id keyID in the publicKey property of an
+// actor, which can be a single object or an array of them
+func findKey(publicKey interface{}, keyID string) map[string]interface{} {
+	switch k := publicKey.(type) {
+	case map[string]interface{}:
+		return k
+	case []interface{}:
+		for _, v := range k {
+			key, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			if id, _ := key["id"].(string); id == keyID {
+				return key
+			}
+		}
+	}
+	return nil
+}
+
+// verifyDate rejects requests whose Date header is further away from
+// our clock than maxClockSkew so that captured requests can't be
+// replayed indefinitely
+func (i *Instance) verifyDate(r *http.Request) error {
+	dateHeader := r.Header.Get("Date")
+	if dateHeader == "" {
+		return errors.New("missing Date header")
+	}
+	date, err := http.ParseTime(dateHeader)
+	if err != nil {
+		return fmt.Errorf("cannot parse Date header %q: %v", dateHeader, err)
+	}
+	skew := time.Since(date)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew > i.maxClockSkew {
+		return fmt.Errorf("Date header %q is outside the allowed window of %s", dateHeader, i.maxClockSkew)
+	}
+	return nil
+}
+
+// verifyDigest recomputes the digest of the body and compares it with
+// the Digest header. The header can contain more than one digest
+// (e.g. `SHA-256=...,SHA-512=...`); all the ones we understand must match
+// and at least one of them must be present
+func verifyDigest(r *http.Request, body []byte) error {
+	digestHeader := r.Header.Get("Digest")
+	if digestHeader == "" {
+		return errors.New("missing Digest header")
+	}
+	verified := false
+	for _, digest := range strings.Split(digestHeader, ",") {
+		parts := strings.SplitN(strings.TrimSpace(digest), "=", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("malformed Digest header %q", digestHeader)
+		}
+		var sum []byte
+		switch strings.ToUpper(parts[0]) {
+		case "SHA-256":
+			s := sha256.Sum256(body)
+			sum = s[:]
+		case "SHA-512":
+			s := sha512.Sum512(body)
+			sum = s[:]
+		default:
+			// ignore algorithms we don't know about
+			continue
+		}
+		expected, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return fmt.Errorf("cannot decode %s digest: %v", parts[0], err)
+		}
+		if !bytes.Equal(sum, expected) {
+			return fmt.Errorf("%s digest does not match the body", parts[0])
+		}
+		verified = true
+	}
+	if !verified {
+		return fmt.Errorf("no supported algorithm in Digest header %q", digestHeader)
+	}
+	return nil
+}
+
+// signingKey is the key an actor signs its requests with, and its id
+type signingKey struct {
+	id  string
+	key crypto.PrivateKey
+}
+
+// signingKey returns the key of the local actor called name, loading
+// the actor only the first time
+func (i *Instance) signingKey(name string) (signingKey, error) {
+	i.actorsMu.Lock()
+	key, ok := i.signingKeys[name]
+	i.actorsMu.Unlock()
+	if ok {
+		return key, nil
+	}
+	actor, err := i.LoadActor(name)
+	if err != nil {
+		return signingKey{}, err
+	}
+	key = signingKey{id: actor.publicKeyID, key: actor.privateKey}
+	i.actorsMu.Lock()
+	i.signingKeys[name] = key
+	i.actorsMu.Unlock()
+	return key, nil
+}
+
+// forgetSigningKey drops the cached key of the actor called name
+func (i *Instance) forgetSigningKey(name string) {
+	i.actorsMu.Lock()
+	delete(i.signingKeys, name)
+	i.actorsMu.Unlock()
+}
@@ -0,0 +1,222 @@
+package activityserve
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-fed/httpsig"
+)
+
+// newTestKey returns a private key and its public half in PEM
+func newTestKey(t *testing.T) (*rsa.PrivateKey, string) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// remoteServer serves the documents in docs (by path) as a remote
+// server would and returns the url it's listening on
+func remoteServer(t *testing.T, docs map[string]func(base string) interface{}) string {
+	t.Helper()
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, ok := docs[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/activity+json")
+		json.NewEncoder(w).Encode(doc(srv.URL))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+// signedRequest returns a POST to our inbox carrying body, signed with key
+func signedRequest(t *testing.T, key *rsa.PrivateKey, keyID string, body []byte, date time.Time) *http.Request {
+	t.Helper()
+	r := httptest.NewRequest("POST", "https://local.example/alice/inbox", bytes.NewReader(body))
+	r.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	r.Header.Set("Host", "local.example")
+	signer, _, err := httpsig.NewSigner([]httpsig.Algorithm{httpsig.RSA_SHA256}, "SHA-256", requiredSignedHeaders, httpsig.Signature, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = signer.SignRequest(key, keyID, r, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func newTestInstance(t *testing.T) *Instance {
+	t.Helper()
+	return NewInstance("https://local.example/", NewFileStore(t.TempDir()))
+}
+
+func TestVerifyRequest(t *testing.T) {
+	key, publicPEM := newTestKey(t)
+	attackerKey, attackerPEM := newTestKey(t)
+	_, otherPEM := newTestKey(t)
+
+	base := remoteServer(t, map[string]func(string) interface{}{
+		// an actor embedding its key, like Mastodon does
+		"/users/bob": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":   base + "/users/bob",
+				"type": "Person",
+				"publicKey": map[string]interface{}{
+					"id":           base + "/users/bob#main-key",
+					"owner":        base + "/users/bob",
+					"publicKeyPem": publicPEM,
+				},
+			}
+		},
+		// an actor whose key is a document of its own
+		"/users/carol": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":   base + "/users/carol",
+				"type": "Person",
+				"publicKey": map[string]interface{}{
+					"id":           base + "/keys/carol",
+					"owner":        base + "/users/carol",
+					"publicKeyPem": publicPEM,
+				},
+			}
+		},
+		"/keys/carol": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":           base + "/keys/carol",
+				"owner":        base + "/users/carol",
+				"publicKeyPem": publicPEM,
+			}
+		},
+		// the victim, with a key the attacker doesn't have
+		"/users/victim": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":   base + "/users/victim",
+				"type": "Person",
+				"publicKey": map[string]interface{}{
+					"id":           base + "/users/victim#main-key",
+					"owner":        base + "/users/victim",
+					"publicKeyPem": otherPEM,
+				},
+			}
+		},
+		// a copy of the victim with the attacker's key in it
+		"/forged-actor": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":   base + "/users/victim",
+				"type": "Person",
+				"publicKey": map[string]interface{}{
+					"publicKeyPem": attackerPEM,
+				},
+			}
+		},
+		// a key document of the attacker claiming to belong to the victim
+		"/forged-key": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":           base + "/forged-key",
+				"owner":        base + "/users/victim",
+				"publicKeyPem": attackerPEM,
+			}
+		},
+	})
+
+	body := []byte(`{"type":"Follow"}`)
+	tests := []struct {
+		name    string
+		key     *rsa.PrivateKey
+		keyID   string
+		actor   string
+		wantErr bool
+	}{
+		{"embedded key", key, base + "/users/bob#main-key", base + "/users/bob", false},
+		{"standalone key", key, base + "/keys/carol", base + "/users/carol", false},
+		{"wrong actor", key, base + "/users/bob#main-key", base + "/users/carol", true},
+		{"forged actor document", attackerKey, base + "/forged-actor", base + "/users/victim", true},
+		{"forged key owner", attackerKey, base + "/forged-key", base + "/users/victim", true},
+		{"wrong key", attackerKey, base + "/users/bob#main-key", base + "/users/bob", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			i := newTestInstance(t)
+			r := signedRequest(t, test.key, test.keyID, body, time.Now())
+			owner, err := i.verifyRequest(r, body, test.actor)
+			if test.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got owner %s", owner)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if owner != test.actor {
+				t.Fatalf("got owner %s, want %s", owner, test.actor)
+			}
+		})
+	}
+}
+
+func TestVerifyRequestDigestMismatch(t *testing.T) {
+	key, publicPEM := newTestKey(t)
+	base := remoteServer(t, map[string]func(string) interface{}{
+		"/users/bob": func(base string) interface{} {
+			return map[string]interface{}{
+				"id":        base + "/users/bob",
+				"publicKey": map[string]interface{}{"id": base + "/users/bob#main-key", "publicKeyPem": publicPEM},
+			}
+		},
+	})
+	i := newTestInstance(t)
+	r := signedRequest(t, key, base+"/users/bob#main-key", []byte(`{"type":"Follow"}`), time.Now())
+	_, err := i.verifyRequest(r, []byte(`{"type":"Delete"}`), base+"/users/bob")
+	if err == nil || !strings.Contains(err.Error(), "digest") {
+		t.Fatalf("expected a digest error, got %v", err)
+	}
+}
+
+func TestVerifyDate(t *testing.T) {
+	i := newTestInstance(t)
+	tests := []struct {
+		name    string
+		date    string
+		wantErr bool
+	}{
+		{"now", time.Now().UTC().Format(http.TimeFormat), false},
+		{"within skew", time.Now().Add(-i.maxClockSkew / 2).UTC().Format(http.TimeFormat), false},
+		{"too old", time.Now().Add(-2 * i.maxClockSkew).UTC().Format(http.TimeFormat), true},
+		{"too far ahead", time.Now().Add(2 * i.maxClockSkew).UTC().Format(http.TimeFormat), true},
+		{"missing", "", true},
+		{"garbage", "yesterday", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("POST", "https://local.example/alice/inbox", nil)
+			if test.date != "" {
+				r.Header.Set("Date", test.date)
+			}
+			err := i.verifyDate(r)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("verifyDate(%q) = %v", test.date, err)
+			}
+		})
+	}
+}
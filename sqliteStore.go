@@ -0,0 +1,596 @@
+package activityserve
+
+import (
+	"database/sql"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gologme/log"
+
+	// pure go sqlite driver, no cgo required
+	_ "modernc.org/sqlite"
+)
+
+// SQLiteStore is a Store that keeps everything in a single
+// SQLite database file
+type SQLiteStore struct {
+	db *sql.DB
+
+	// saved holds the actors as they are in the database so that saving
+	// one only writes the peers that changed instead of all of them
+	saved   map[string]*ActorToSave
+	savedMu sync.Mutex
+}
+
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS actors (
+		name TEXT PRIMARY KEY,
+		summary TEXT NOT NULL,
+		actor_type TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		private_key TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS followers (
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		inbox TEXT NOT NULL,
+		PRIMARY KEY (actor, iri)
+	)`,
+	`CREATE TABLE IF NOT EXISTS following (
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (actor, iri)
+	)`,
+	`CREATE TABLE IF NOT EXISTS requested (
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		PRIMARY KEY (actor, iri)
+	)`,
+	`CREATE TABLE IF NOT EXISTS rejected (
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		PRIMARY KEY (actor, iri)
+	)`,
+	`CREATE TABLE IF NOT EXISTS items (
+		actor TEXT NOT NULL,
+		hash TEXT NOT NULL,
+		data TEXT NOT NULL,
+		PRIMARY KEY (actor, hash)
+	)`,
+	`CREATE TABLE IF NOT EXISTS outbox (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS outbox_actor ON outbox (actor, id)`,
+	`CREATE TABLE IF NOT EXISTS foreign_objects (
+		iri TEXT PRIMARY KEY,
+		data TEXT NOT NULL
+	)`,
+	`CREATE TABLE IF NOT EXISTS deliveries (
+		id TEXT PRIMARY KEY,
+		actor TEXT NOT NULL,
+		inbox TEXT NOT NULL,
+		activity TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		created INTEGER NOT NULL,
+		next_attempt INTEGER NOT NULL,
+		last_error TEXT NOT NULL,
+		dead INTEGER NOT NULL DEFAULT 0
+	)`,
+	`CREATE INDEX IF NOT EXISTS deliveries_due ON deliveries (dead, next_attempt)`,
+	`CREATE TABLE IF NOT EXISTS pending (
+		actor TEXT NOT NULL,
+		iri TEXT NOT NULL,
+		activity TEXT NOT NULL,
+		PRIMARY KEY (actor, iri)
+	)`,
+}
+
+// changes to tables that already existed in older versions of the
+// schema. Failing because the column exists already is fine
+var sqliteMigrations = []string{
+	`ALTER TABLE followers ADD COLUMN shared_inbox TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE followers ADD COLUMN follow_id TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE actors ADD COLUMN manually_approves INTEGER NOT NULL DEFAULT 0`,
+	`ALTER TABLE actors ADD COLUMN also_known_as TEXT NOT NULL DEFAULT '[]'`,
+	`ALTER TABLE actors ADD COLUMN moved_to TEXT NOT NULL DEFAULT ''`,
+}
+
+// the tables that hold the peers of an actor and the column that
+// holds the value of each entry in the actor's maps
+var sqlitePeerTables = []struct{ table, column string }{
+	{"followers", "inbox"},
+	{"following", "hash"},
+	{"requested", "hash"},
+	{"rejected", ""},
+}
+
+// NewSQLiteStore opens (and creates if needed) the SQLite database
+// at path
+func NewSQLiteStore(path string) (*SQLiteStore, error) {
+	db, err := sql.Open("sqlite", "file:"+path+"?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)")
+	if err != nil {
+		log.Info("Can't open the sqlite database " + path)
+		return nil, err
+	}
+	// sqlite only supports one writer at a time
+	db.SetMaxOpenConns(1)
+	for _, statement := range sqliteSchema {
+		_, err = db.Exec(statement)
+		if err != nil {
+			log.Info("Can't create the sqlite schema")
+			db.Close()
+			return nil, err
+		}
+	}
+	for _, statement := range sqliteMigrations {
+		_, err = db.Exec(statement)
+		if err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			log.Info("Can't migrate the sqlite schema")
+			db.Close()
+			return nil, err
+		}
+	}
+	return &SQLiteStore{db: db, saved: make(map[string]*ActorToSave)}, nil
+}
+
+// Close closes the underlying database
+func (s *SQLiteStore) Close() error {
+	return s.db.Close()
+}
+
+// SaveActor writes the actor and the peers that changed since it was
+// last saved or loaded in one transaction
+func (s *SQLiteStore) SaveActor(actor *ActorToSave) error {
+	s.savedMu.Lock()
+	defer s.savedMu.Unlock()
+	previous, ok := s.saved[actor.Name]
+	if !ok {
+		var err error
+		previous, err = s.loadActor(actor.Name)
+		if err == ErrNotFound {
+			previous = &ActorToSave{}
+		} else if err != nil {
+			return err
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	aliases, err := json.Marshal(actor.AlsoKnownAs)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO actors (name, summary, actor_type, iri, public_key, private_key, manually_approves,
+			also_known_as, moved_to)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET summary = excluded.summary,
+			actor_type = excluded.actor_type, iri = excluded.iri,
+			public_key = excluded.public_key, private_key = excluded.private_key,
+			manually_approves = excluded.manually_approves,
+			also_known_as = excluded.also_known_as, moved_to = excluded.moved_to`,
+		actor.Name, actor.Summary, actor.ActorType, actor.IRI, actor.PublicKey, actor.PrivateKey,
+		actor.ManuallyApprovesFollowers, string(aliases), actor.MovedTo)
+	if err != nil {
+		return err
+	}
+
+	pending, err := pendingRows(actor)
+	if err != nil {
+		return err
+	}
+	previousPending, err := pendingRows(previous)
+	if err != nil {
+		return err
+	}
+	err = savePeerChanges(tx, "DELETE FROM pending WHERE actor = ? AND iri = ?",
+		`INSERT INTO pending (actor, iri, activity) VALUES (?, ?, ?)
+		ON CONFLICT (actor, iri) DO UPDATE SET activity = excluded.activity`,
+		actor.Name, previousPending, pending)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range sqlitePeerTables {
+		insert := "INSERT INTO " + t.table + " (actor, iri) VALUES (?, ?) ON CONFLICT (actor, iri) DO NOTHING"
+		switch {
+		case t.table == "followers":
+			insert = `INSERT INTO followers (actor, iri, inbox, shared_inbox, follow_id) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (actor, iri) DO UPDATE SET inbox = excluded.inbox,
+					shared_inbox = excluded.shared_inbox, follow_id = excluded.follow_id`
+		case t.column != "":
+			insert = "INSERT INTO " + t.table + " (actor, iri, " + t.column + ") VALUES (?, ?, ?)" +
+				" ON CONFLICT (actor, iri) DO UPDATE SET " + t.column + " = excluded." + t.column
+		}
+		err = savePeerChanges(tx, "DELETE FROM "+t.table+" WHERE actor = ? AND iri = ?", insert,
+			actor.Name, peerRows(previous, t.table, t.column), peerRows(actor, t.table, t.column))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		// we don't know what made it to the database anymore
+		delete(s.saved, actor.Name)
+		return err
+	}
+	s.saved[actor.Name] = copyActorToSave(actor)
+	return nil
+}
+
+// peerRows returns the values of the columns after actor and iri of each
+// row of a peer table of the actor
+func peerRows(actor *ActorToSave, table, column string) map[string][]interface{} {
+	var peers map[string]interface{}
+	switch table {
+	case "followers":
+		peers = actor.Followers
+	case "following":
+		peers = actor.Following
+	case "requested":
+		peers = actor.Requested
+	case "rejected":
+		peers = actor.Rejected
+	}
+	rows := make(map[string][]interface{}, len(peers))
+	for iri, value := range peers {
+		v, _ := value.(string)
+		switch {
+		case table == "followers":
+			shared, _ := actor.SharedInboxes[iri].(string)
+			followID, _ := actor.FollowIDs[iri].(string)
+			rows[iri] = []interface{}{v, shared, followID}
+		case column == "":
+			rows[iri] = nil
+		default:
+			rows[iri] = []interface{}{v}
+		}
+	}
+	return rows
+}
+
+// pendingRows returns the rows of the pending table of the actor
+func pendingRows(actor *ActorToSave) (map[string][]interface{}, error) {
+	rows := make(map[string][]interface{}, len(actor.Pending))
+	for iri, follow := range actor.Pending {
+		JSON, err := json.Marshal(follow)
+		if err != nil {
+			return nil, err
+		}
+		rows[iri] = []interface{}{string(JSON)}
+	}
+	return rows, nil
+}
+
+// savePeerChanges deletes the rows that are in previous but not in
+// current and upserts the ones that are new or changed
+func savePeerChanges(tx *sql.Tx, del, upsert, actor string, previous, current map[string][]interface{}) error {
+	for iri := range previous {
+		if _, ok := current[iri]; !ok {
+			_, err := tx.Exec(del, actor, iri)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for iri, values := range current {
+		if old, ok := previous[iri]; ok && equalValues(old, values) {
+			continue
+		}
+		_, err := tx.Exec(upsert, append([]interface{}{actor, iri}, values...)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func equalValues(a, b []interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// copyActorToSave copies the actor and its maps so that later changes
+// to the actor don't change the copy
+func copyActorToSave(actor *ActorToSave) *ActorToSave {
+	c := *actor
+	for _, m := range []*map[string]interface{}{&c.Followers, &c.Following, &c.Requested,
+		&c.Rejected, &c.SharedInboxes, &c.FollowIDs, &c.Pending} {
+		copied := make(map[string]interface{}, len(*m))
+		for k, v := range *m {
+			copied[k] = v
+		}
+		*m = copied
+	}
+	return &c
+}
+
+// LoadActor reads the actor and its peers
+func (s *SQLiteStore) LoadActor(name string) (*ActorToSave, error) {
+	s.savedMu.Lock()
+	defer s.savedMu.Unlock()
+	actor, err := s.loadActor(name)
+	if err != nil {
+		return nil, err
+	}
+	s.saved[name] = copyActorToSave(actor)
+	return actor, nil
+}
+
+func (s *SQLiteStore) loadActor(name string) (*ActorToSave, error) {
+	actor := &ActorToSave{Name: name}
+	var aliases string
+	err := s.db.QueryRow(`SELECT summary, actor_type, iri, public_key, private_key, manually_approves,
+			also_known_as, moved_to
+		FROM actors WHERE name = ?`, name).
+		Scan(&actor.Summary, &actor.ActorType, &actor.IRI, &actor.PublicKey, &actor.PrivateKey,
+			&actor.ManuallyApprovesFollowers, &aliases, &actor.MovedTo)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal([]byte(aliases), &actor.AlsoKnownAs)
+	if err != nil {
+		return nil, err
+	}
+
+	peers := []*map[string]interface{}{&actor.Followers, &actor.Following, &actor.Requested, &actor.Rejected}
+	for i, t := range sqlitePeerTables {
+		column := "''"
+		if t.column != "" {
+			column = t.column
+		}
+		rows, err := s.db.Query("SELECT iri, "+column+" FROM "+t.table+" WHERE actor = ?", name)
+		if err != nil {
+			return nil, err
+		}
+		m := make(map[string]interface{})
+		for rows.Next() {
+			var iri, value string
+			err = rows.Scan(&iri, &value)
+			if err != nil {
+				rows.Close()
+				return nil, err
+			}
+			m[iri] = value
+		}
+		rows.Close()
+		*peers[i] = m
+	}
+
+	actor.Pending = make(map[string]interface{})
+	rows, err := s.db.Query("SELECT iri, activity FROM pending WHERE actor = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var iri, activity string
+		var follow map[string]interface{}
+		err = rows.Scan(&iri, &activity)
+		if err == nil {
+			err = json.Unmarshal([]byte(activity), &follow)
+		}
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		actor.Pending[iri] = follow
+	}
+	rows.Close()
+
+	rows, err = s.db.Query("SELECT iri, shared_inbox, follow_id FROM followers WHERE actor = ?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	actor.SharedInboxes = make(map[string]interface{})
+	actor.FollowIDs = make(map[string]interface{})
+	for rows.Next() {
+		var iri, sharedInbox, followID string
+		err = rows.Scan(&iri, &sharedInbox, &followID)
+		if err != nil {
+			return nil, err
+		}
+		if sharedInbox != "" {
+			actor.SharedInboxes[iri] = sharedInbox
+		}
+		if followID != "" {
+			actor.FollowIDs[iri] = followID
+		}
+	}
+	return actor, rows.Err()
+}
+
+// ActorNames returns the names in the actors table
+func (s *SQLiteStore) ActorNames() ([]string, error) {
+	rows, err := s.db.Query("SELECT name FROM actors ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	names := make([]string, 0)
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// SaveItem stores the item as JSON
+func (s *SQLiteStore) SaveItem(actor, hash string, item interface{}) error {
+	JSON, err := json.Marshal(item)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO items (actor, hash, data) VALUES (?, ?, ?)
+		ON CONFLICT (actor, hash) DO UPDATE SET data = excluded.data`, actor, hash, string(JSON))
+	return err
+}
+
+// LoadItem reads an item
+func (s *SQLiteStore) LoadItem(actor, hash string) (map[string]interface{}, error) {
+	return s.loadJSON("SELECT data FROM items WHERE actor = ? AND hash = ?", actor, hash)
+}
+
+// RemoveFromOutbox deletes the iri from the outbox
+func (s *SQLiteStore) RemoveFromOutbox(actor, iri string) error {
+	_, err := s.db.Exec("DELETE FROM outbox WHERE actor = ? AND iri = ?", actor, iri)
+	return err
+}
+
+// AppendToOutbox adds the iri to the end of the outbox
+func (s *SQLiteStore) AppendToOutbox(actor, iri string) error {
+	_, err := s.db.Exec("INSERT INTO outbox (actor, iri) VALUES (?, ?)", actor, iri)
+	return err
+}
+
+// OutboxCount returns the size of the outbox
+func (s *SQLiteStore) OutboxCount(actor string) (count int, err error) {
+	err = s.db.QueryRow("SELECT COUNT(*) FROM outbox WHERE actor = ?", actor).Scan(&count)
+	return
+}
+
+// Outbox returns a page of the outbox, oldest first
+func (s *SQLiteStore) Outbox(actor string, offset, limit int) ([]string, error) {
+	rows, err := s.db.Query("SELECT iri FROM outbox WHERE actor = ? ORDER BY id LIMIT ? OFFSET ?", actor, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	iris := make([]string, 0, limit)
+	for rows.Next() {
+		var iri string
+		err = rows.Scan(&iri)
+		if err != nil {
+			return nil, err
+		}
+		iris = append(iris, iri)
+	}
+	return iris, rows.Err()
+}
+
+// SaveForeign caches a foreign object
+func (s *SQLiteStore) SaveForeign(iri string, object map[string]interface{}) error {
+	JSON, err := json.Marshal(object)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT INTO foreign_objects (iri, data) VALUES (?, ?)
+		ON CONFLICT (iri) DO UPDATE SET data = excluded.data`, iri, string(JSON))
+	return err
+}
+
+// LoadForeign reads a cached foreign object
+func (s *SQLiteStore) LoadForeign(iri string) (map[string]interface{}, error) {
+	return s.loadJSON("SELECT data FROM foreign_objects WHERE iri = ?", iri)
+}
+
+// DeleteForeign removes a cached foreign object
+func (s *SQLiteStore) DeleteForeign(iri string) error {
+	_, err := s.db.Exec("DELETE FROM foreign_objects WHERE iri = ?", iri)
+	return err
+}
+
+// saveJob inserts or updates a delivery job
+func (s *SQLiteStore) saveJob(job *DeliveryJob, dead bool) error {
+	_, err := s.db.Exec(`INSERT INTO deliveries (id, actor, inbox, activity, attempts, created, next_attempt, last_error, dead)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (id) DO UPDATE SET attempts = excluded.attempts,
+			next_attempt = excluded.next_attempt, last_error = excluded.last_error,
+			dead = excluded.dead`,
+		job.ID, job.Actor, job.Inbox, string(job.Activity), job.Attempts,
+		job.Created.UnixNano(), job.NextAttempt.UnixNano(), job.LastError, dead)
+	return err
+}
+
+// queryJobs returns the delivery jobs matched by a query on the
+// deliveries table
+func (s *SQLiteStore) queryJobs(where string, args ...interface{}) ([]*DeliveryJob, error) {
+	rows, err := s.db.Query(`SELECT id, actor, inbox, activity, attempts, created, next_attempt, last_error
+		FROM deliveries WHERE `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	jobs := make([]*DeliveryJob, 0)
+	for rows.Next() {
+		job := &DeliveryJob{}
+		var activity string
+		var created, nextAttempt int64
+		err = rows.Scan(&job.ID, &job.Actor, &job.Inbox, &activity, &job.Attempts, &created, &nextAttempt, &job.LastError)
+		if err != nil {
+			return nil, err
+		}
+		job.Activity = json.RawMessage(activity)
+		job.Created = time.Unix(0, created)
+		job.NextAttempt = time.Unix(0, nextAttempt)
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// SaveDelivery queues a delivery job
+func (s *SQLiteStore) SaveDelivery(job *DeliveryJob) error {
+	return s.saveJob(job, false)
+}
+
+// DueDeliveries returns the queued jobs that are due
+func (s *SQLiteStore) DueDeliveries(before time.Time, offset, limit int) ([]*DeliveryJob, error) {
+	return s.queryJobs("dead = 0 AND next_attempt <= ? ORDER BY next_attempt, id LIMIT ? OFFSET ?", before.UnixNano(), limit, offset)
+}
+
+// DeleteDelivery removes a delivery job
+func (s *SQLiteStore) DeleteDelivery(id string) error {
+	_, err := s.db.Exec("DELETE FROM deliveries WHERE id = ?", id)
+	return err
+}
+
+// SaveDeadLetter marks a delivery job as dead
+func (s *SQLiteStore) SaveDeadLetter(job *DeliveryJob) error {
+	return s.saveJob(job, true)
+}
+
+// DeadLetters returns the dead delivery jobs
+func (s *SQLiteStore) DeadLetters() ([]*DeliveryJob, error) {
+	return s.queryJobs("dead = 1 ORDER BY created")
+}
+
+// loadJSON runs a query returning a single JSON column and
+// unmarshals it
+func (s *SQLiteStore) loadJSON(query string, args ...interface{}) (map[string]interface{}, error) {
+	var data string
+	err := s.db.QueryRow(query, args...).Scan(&data)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	var object map[string]interface{}
+	err = json.Unmarshal([]byte(data), &object)
+	return object, err
+}
@@ -0,0 +1,84 @@
+package activityserve
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSQLiteStoreSaveActorChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	s, err := NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	actor := &ActorToSave{
+		Name:          "alice",
+		AlsoKnownAs:   []string{},
+		Followers:     map[string]interface{}{"https://a.example/bob": "https://a.example/bob/inbox"},
+		Following:     map[string]interface{}{"https://a.example/carol": "hash1"},
+		Requested:     map[string]interface{}{},
+		Rejected:      map[string]interface{}{"https://a.example/dan": ""},
+		SharedInboxes: map[string]interface{}{"https://a.example/bob": "https://a.example/inbox"},
+		FollowIDs:     map[string]interface{}{"https://a.example/bob": "https://a.example/follow/1"},
+		Pending:       map[string]interface{}{},
+	}
+	err = s.SaveActor(actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// add, change and remove peers
+	actor.Followers["https://b.example/erin"] = "https://b.example/erin/inbox"
+	actor.FollowIDs["https://b.example/erin"] = "https://b.example/follow/2"
+	actor.SharedInboxes["https://a.example/bob"] = "https://a.example/shared"
+	actor.Following["https://a.example/carol"] = "hash2"
+	actor.Requested["https://c.example/frank"] = "hash3"
+	delete(actor.Rejected, "https://a.example/dan")
+	actor.Pending["https://d.example/gina"] = map[string]interface{}{"type": "Follow"}
+	err = s.SaveActor(actor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a new store has nothing cached and reads everything from the database
+	s.Close()
+	s, err = NewSQLiteStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := s.LoadActor("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, pair := range map[string][2]map[string]interface{}{
+		"followers":     {actor.Followers, loaded.Followers},
+		"following":     {actor.Following, loaded.Following},
+		"requested":     {actor.Requested, loaded.Requested},
+		"rejected":      {actor.Rejected, loaded.Rejected},
+		"sharedInboxes": {actor.SharedInboxes, loaded.SharedInboxes},
+		"followIDs":     {actor.FollowIDs, loaded.FollowIDs},
+		"pending":       {actor.Pending, loaded.Pending},
+	} {
+		if !reflect.DeepEqual(pair[0], pair[1]) {
+			t.Errorf("%s: saved %v, loaded %v", name, pair[0], pair[1])
+		}
+	}
+
+	// removing a follower after loading deletes its row
+	delete(loaded.Followers, "https://a.example/bob")
+	err = s.SaveActor(loaded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	err = s.db.QueryRow("SELECT COUNT(*) FROM followers WHERE actor = 'alice'").Scan(&count)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1 {
+		t.Errorf("got %d followers, want 1", count)
+	}
+}
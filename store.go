@@ -0,0 +1,71 @@
+package activityserve
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotFound is returned by a Store when the requested actor, item
+// or object does not exist
+var ErrNotFound = errors.New("not found")
+
+// Store is the storage backend of activityserve. Everything we need
+// to remember between requests goes through it so that applications
+// can plug in their own database instead of the default JSON files
+// (see FileStore).
+type Store interface {
+	// SaveActor writes a local actor to storage. The followers,
+	// following, requested and rejected lists are part of the actor
+	// and are saved along with it.
+	SaveActor(actor *ActorToSave) error
+	// LoadActor reads a local actor from storage. It returns
+	// ErrNotFound if there's no actor with that name.
+	LoadActor(name string) (*ActorToSave, error)
+	// ActorNames returns the names of all the local actors
+	ActorNames() ([]string, error)
+
+	// SaveItem stores an activity or object that belongs to a
+	// local actor under its hash (the last part of its id)
+	SaveItem(actor, hash string, item interface{}) error
+	// LoadItem returns an item stored with SaveItem or ErrNotFound
+	LoadItem(actor, hash string) (map[string]interface{}, error)
+
+	// AppendToOutbox adds the id of an activity to the end of the
+	// outbox of a local actor
+	AppendToOutbox(actor, iri string) error
+	// RemoveFromOutbox removes the id of an activity from the outbox
+	RemoveFromOutbox(actor, iri string) error
+	// OutboxCount returns the number of activities in the outbox
+	OutboxCount(actor string) (int, error)
+	// Outbox returns at most limit activity ids from the outbox of
+	// an actor starting from offset, oldest first
+	Outbox(actor string, offset, limit int) ([]string, error)
+
+	// SaveForeign caches an object that doesn't belong to us
+	// (remote actors, their keys, posts etc.) under its iri
+	SaveForeign(iri string, object map[string]interface{}) error
+	// LoadForeign returns a cached foreign object or ErrNotFound
+	LoadForeign(iri string) (map[string]interface{}, error)
+	// DeleteForeign removes a cached foreign object
+	DeleteForeign(iri string) error
+
+	// SaveDelivery adds a job to the delivery queue or updates it
+	// if it's already there
+	SaveDelivery(job *DeliveryJob) error
+	// DueDeliveries returns at most limit queued jobs whose NextAttempt
+	// is not after before, oldest first, skipping the first offset ones
+	DueDeliveries(before time.Time, offset, limit int) ([]*DeliveryJob, error)
+	// DeleteDelivery removes a job from the delivery queue
+	DeleteDelivery(id string) error
+	// SaveDeadLetter moves a job from the delivery queue to the
+	// list of deliveries we gave up on
+	SaveDeadLetter(job *DeliveryJob) error
+	// DeadLetters returns the deliveries we gave up on
+	DeadLetters() ([]*DeliveryJob, error)
+}
+
+// SetStore replaces the storage backend. Call it after Setup and
+// before creating or loading any actors.
+func SetStore(s Store) {
+	defaultInstance.SetStore(s)
+}
@@ -17,8 +17,8 @@ func isSuccess(code int) bool {
 		code == http.StatusNoContent
 }
 
-// PrettyPrint maps
-func PrettyPrint(themap map[string]interface{}) {
+// PrettyPrint maps and activities
+func PrettyPrint(themap interface{}) {
 	b, err := json.MarshalIndent(themap, "", "  ")
 	if err != nil {
 		log.Info("error:", err)
@@ -52,6 +52,19 @@ func context() [1]string {
 	return [1]string{"https://www.w3.org/ns/activitystreams"}
 }
 
+// noteContext adds the extensions notes use to the activitystreams context
+func noteContext() []interface{} {
+	return []interface{}{
+		"https://www.w3.org/ns/activitystreams",
+		map[string]string{
+			"toot":        "http://joinmastodon.org/ns#",
+			"blurhash":    "toot:blurhash",
+			"sensitive":   "as:sensitive",
+			"votersCount": "toot:votersCount",
+		},
+	}
+}
+
 // ReadLines reads specific lines from a file and returns them as
 // an array of strings
 func ReadLines(filename string, from, to int) (lines []string, err error) {
@@ -97,3 +110,44 @@ func lineCounter(filename string) (int, error) {
 		}
 	}
 }
+
+func containsString(slice []string, s string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// nonNil returns m or an empty map if m is nil
+func nonNil(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return make(map[string]interface{})
+	}
+	return m
+}
+
+// stringsOf reads a property that can be a string or an array of
+// them (see Strings) from an object we have as a map
+func stringsOf(value interface{}) Strings {
+	var s Strings
+	b, err := json.Marshal(value)
+	if err == nil {
+		json.Unmarshal(b, &s)
+	}
+	return s
+}
+
+// iriOf returns the iri of a property that can either be the
+// iri itself or an embedded object with an id
+func iriOf(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case map[string]interface{}:
+		id, _ := v["id"].(string)
+		return id
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+package activityserve
+
+import (
+	"net/http"
+
+	"github.com/gologme/log"
+)
+
+// Visibility says who can see a post, following the addressing
+// conventions of Mastodon
+type Visibility int
+
+const (
+	// VisibilityPublic posts are addressed to everybody and listed
+	// in the outbox
+	VisibilityPublic Visibility = iota
+	// VisibilityUnlisted posts can be seen by everybody but are meant to
+	// stay out of public timelines, so Public is only in cc
+	VisibilityUnlisted
+	// VisibilityFollowers posts are only addressed to our followers and
+	// only shown in the outbox to followers that sign their request
+	VisibilityFollowers
+	// VisibilityDirect posts are only addressed and delivered to their
+	// recipients and are not listed in the outbox
+	VisibilityDirect
+)
+
+// address returns the to and cc of a post of the actor with
+// that visibility and explicit recipients
+func (a *Actor) address(visibility Visibility, recipients []string) (to, cc Strings) {
+	switch visibility {
+	case VisibilityUnlisted:
+		to = Strings{a.followersIRI}
+		cc = Strings{activityStreamsPublic}
+	case VisibilityFollowers:
+		to = Strings{a.followersIRI}
+	case VisibilityDirect:
+		return Strings(recipients), nil
+	default:
+		to = Strings{activityStreamsPublic}
+		cc = Strings{a.followersIRI}
+	}
+	return to, append(cc, recipients...)
+}
+
+// visibilityOf returns the visibility of one of our posts from the way
+// address addressed it
+func (a *Actor) visibilityOf(post *Object) Visibility {
+	switch {
+	case post.To.Contains(activityStreamsPublic):
+		return VisibilityPublic
+	case post.CC.Contains(activityStreamsPublic):
+		return VisibilityUnlisted
+	case post.To.Contains(a.followersIRI) || post.CC.Contains(a.followersIRI):
+		return VisibilityFollowers
+	}
+	return VisibilityDirect
+}
+
+// isPublic tells whether an object, or the object of an activity,
+// is addressed to everybody
+func isPublic(object *Object) bool {
+	// there's nothing to hide in a tombstone
+	if object.Type == "Tombstone" {
+		return true
+	}
+	for _, public := range []string{activityStreamsPublic, "as:Public", "Public"} {
+		if object.To.Contains(public) || object.CC.Contains(public) {
+			return true
+		}
+	}
+	if object.Object != nil && object.Object.Object != nil {
+		return isPublic(object.Object.Object)
+	}
+	return false
+}
+
+// mayRead tells whether the remote actor fetcher is allowed to see one
+// of our items. Public items can be seen by anybody (fetcher can be empty
+// for unsigned requests), the rest by the actors they are addressed to
+// and by our followers if they are addressed to them
+func (a *Actor) mayRead(item *Object, fetcher string) bool {
+	if isPublic(item) {
+		return true
+	}
+	if fetcher == "" {
+		return false
+	}
+	for object := item; object != nil; {
+		for _, audience := range []Strings{object.To, object.CC, object.BTo, object.BCC} {
+			if audience.Contains(fetcher) {
+				return true
+			}
+			if audience.Contains(a.followersIRI) {
+				if a.isFollower(fetcher) {
+					return true
+				}
+			}
+		}
+		if object.Object == nil {
+			break
+		}
+		object = object.Object.Object
+	}
+	return false
+}
+
+// signedFetcher returns the actor that signed a GET request, or an
+// empty string if the request is not signed or the signature is invalid
+func (i *Instance) signedFetcher(r *http.Request) string {
+	if r.Header.Get("Signature") == "" && r.Header.Get("Authorization") == "" {
+		return ""
+	}
+	err := i.verifyDate(r)
+	if err == nil {
+		var fetcher string
+		fetcher, err = i.verifySignature(r, []string{"(request-target)", "host", "date"})
+		if err == nil {
+			return fetcher
+		}
+	}
+	log.Info("Failed to verify the signature of a GET request")
+	log.Info(err)
+	return ""
+}